@@ -0,0 +1,620 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/ggkop/agent/config"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeDNS01     = "dns-01"
+
+	// ALPNProto is the protocol CAs offer on TLS-ALPN-01 validation handshakes
+	ALPNProto = acme.ALPNProto
+
+	CoordinationCore = "core" // Core grants one ordering agent per domain
+	CoordinationNone = "none" // every agent orders on its own
+
+	leaseTTL         = 10 * time.Minute
+	orderTimeout     = 5 * time.Minute
+	maxRetryDelay    = 24 * time.Hour
+	propagationCheck = time.Second
+)
+
+// Config holds the agent-local ACME settings.
+type Config struct {
+	DirectoryURL  string // ACME directory, Let's Encrypt when empty
+	Email         string // account contact, optional
+	StorageDir    string
+	CACertFile    string   // extra roots for the directory's TLS certificate, e.g. Pebble's
+	Challenges    []string // challenge types in order of preference
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	Coordination  string
+
+	// PropagationWait is how long after Core delivers a published challenge
+	// to this agent the others may take to poll it: the polling interval.
+	PropagationWait time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DirectoryURL:  acme.LetsEncryptURL,
+		StorageDir:    "/var/lib/ggkop-agent/acme",
+		Challenges:    []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01},
+		RenewBefore:   30 * 24 * time.Hour,
+		CheckInterval: time.Hour,
+		Coordination:  CoordinationCore,
+	}
+}
+
+// DNSProvider publishes the TXT records of DNS-01 challenges.
+type DNSProvider interface {
+	SetACMEChallenge(name, value string)
+	ClearACMEChallenge(name, value string)
+}
+
+// Manager orders and renews certificates for domains with SSL.AutoRenew and
+// answers the challenges of its own orders. A nil *Manager answers nothing.
+type Manager struct {
+	cfg       Config
+	configMgr *config.ConfigManager
+	store     *Store
+	client    *acme.Client
+	dns       DNSProvider
+
+	mu        sync.RWMutex
+	certs     map[string]*tls.Certificate
+	tokens    map[string]string           // HTTP-01 token → key authorization
+	alpnCerts map[string]*tls.Certificate // TLS-ALPN-01 certificates by domain
+	retries   map[string]retryState
+
+	registered bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+type retryState struct {
+	failures int
+	next     time.Time
+}
+
+func NewManager(configMgr *config.ConfigManager, cfg Config) (*Manager, error) {
+	defaults := DefaultConfig()
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = defaults.DirectoryURL
+	}
+	if cfg.StorageDir == "" {
+		cfg.StorageDir = defaults.StorageDir
+	}
+	if len(cfg.Challenges) == 0 {
+		cfg.Challenges = defaults.Challenges
+	}
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = defaults.RenewBefore
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = defaults.CheckInterval
+	}
+	if cfg.Coordination == "" {
+		cfg.Coordination = defaults.Coordination
+	}
+
+	for i, typ := range cfg.Challenges {
+		cfg.Challenges[i] = strings.ToLower(typ)
+		switch cfg.Challenges[i] {
+		case ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01:
+		default:
+			return nil, fmt.Errorf("unknown challenge type %q", typ)
+		}
+	}
+	if cfg.Coordination != CoordinationCore && cfg.Coordination != CoordinationNone {
+		return nil, fmt.Errorf("unknown coordination mode %q", cfg.Coordination)
+	}
+
+	store, err := NewStore(cfg.StorageDir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.AccountKey()
+	if err != nil {
+		return nil, fmt.Errorf("acme account key: %w", err)
+	}
+	httpClient, err := newHTTPClient(cfg.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		cfg:       cfg,
+		configMgr: configMgr,
+		store:     store,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+		certs:     make(map[string]*tls.Certificate),
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+		retries:   make(map[string]retryState),
+	}, nil
+}
+
+// SetDNSProvider enables DNS-01 challenges through p.
+func (m *Manager) SetDNSProvider(p DNSProvider) {
+	m.dns = p
+}
+
+// Start checks the certificates now and then every CheckInterval.
+func (m *Manager) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
+	log.Printf("[ACME] Using %s, renewing %s before expiry", m.cfg.DirectoryURL, m.cfg.RenewBefore)
+	go m.run(ctx)
+}
+
+// Shutdown aborts a running order and waits for the renewal loop to stop.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	if m.cancel == nil {
+		return nil
+	}
+	m.cancel()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) run(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check renews every auto-renew domain whose certificate expires within
+// RenewBefore, or that has none.
+func (m *Manager) check(ctx context.Context) {
+	for _, domain := range m.configMgr.GetAllDomains() {
+		if !domain.SSL.Enabled || !domain.SSL.AutoRenew {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		name := strings.ToLower(domain.Domain)
+		now := time.Now()
+		if !m.due(name, now) {
+			continue
+		}
+		if expiry, ok := m.expiry(&domain); ok && expiry.Sub(now) > m.cfg.RenewBefore {
+			continue
+		}
+
+		if err := m.renew(ctx, name); err != nil {
+			delay := m.failed(name, now)
+			log.Printf("[ACME] Failed to obtain certificate for %s (retrying in %s): %v", name, delay, err)
+			continue
+		}
+		m.mu.Lock()
+		delete(m.retries, name)
+		m.mu.Unlock()
+	}
+}
+
+// expiry returns the later expiry of the stored certificate and the one
+// from Core.
+func (m *Manager) expiry(domain *config.Domain) (time.Time, bool) {
+	var expiry time.Time
+	if cert := m.loadCertificate(strings.ToLower(domain.Domain)); cert != nil {
+		expiry = cert.Leaf.NotAfter
+	}
+	if block, _ := pem.Decode([]byte(domain.SSL.Certificate)); block != nil {
+		if leaf, err := x509.ParseCertificate(block.Bytes); err == nil && leaf.NotAfter.After(expiry) {
+			expiry = leaf.NotAfter
+		}
+	}
+	return expiry, !expiry.IsZero()
+}
+
+// loadCertificate returns the certificate of domain, reading it from the
+// store on first use.
+func (m *Manager) loadCertificate(domain string) *tls.Certificate {
+	m.mu.RLock()
+	cert, ok := m.certs[domain]
+	m.mu.RUnlock()
+	if ok {
+		return cert
+	}
+
+	cert, err := m.store.Load(domain)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[ACME] Error loading stored certificate: %v", err)
+		}
+		return nil
+	}
+	m.mu.Lock()
+	m.certs[domain] = cert
+	m.mu.Unlock()
+	return cert
+}
+
+func (m *Manager) due(domain string, now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !now.Before(m.retries[domain].next)
+}
+
+// failed backs off exponentially from one hour up to a day.
+func (m *Manager) failed(domain string, now time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.retries[domain]
+	delay := time.Hour << state.failures
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	} else {
+		state.failures++
+	}
+	state.next = now.Add(delay)
+	m.retries[domain] = state
+	return delay
+}
+
+// renew orders a certificate for domain unless another agent holds the
+// fleet-wide lease for it. A Core without the lease endpoint turns
+// coordination off for good.
+func (m *Manager) renew(ctx context.Context, domain string) error {
+	if m.cfg.Coordination == CoordinationCore {
+		granted, holder, err := m.configMgr.AcquireACMELease(domain, leaseTTL)
+		switch {
+		case errors.Is(err, config.ErrCoreUnsupported):
+			log.Printf("[ACME] WARNING: Core does not support ACME coordination, falling back to %q: challenges are answered by this agent only", CoordinationNone)
+			m.cfg.Coordination = CoordinationNone
+		case err != nil:
+			return fmt.Errorf("acquire lease: %w", err)
+		case !granted:
+			log.Printf("[ACME] Agent %s is ordering the certificate for %s", holder, domain)
+			return nil
+		}
+	}
+
+	log.Printf("[ACME] Ordering certificate for %s", domain)
+	ctx, cancel := context.WithTimeout(ctx, orderTimeout)
+	defer cancel()
+
+	certPEM, keyPEM, err := m.obtain(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Save(domain, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("store certificate: %w", err)
+	}
+	cert, err := m.store.Load(domain)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certs[domain] = cert
+	m.mu.Unlock()
+	log.Printf("[ACME] Obtained certificate for %s, valid until %s", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+
+	if m.cfg.Coordination == CoordinationCore {
+		if err := m.configMgr.UploadCertificate(domain, string(certPEM), string(keyPEM)); err != nil {
+			log.Printf("[ACME] Error uploading certificate for %s to Core: %v", domain, err)
+		}
+	}
+	return nil
+}
+
+// obtain runs an ACME order for domain and returns the certificate chain
+// and a new private key, both PEM.
+func (m *Manager) obtain(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	if err := m.register(ctx); err != nil {
+		return nil, nil, fmt.Errorf("register account: %w", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, nil, fmt.Errorf("create order: %w", err)
+	}
+
+	var cleanups []func()
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+	for _, url := range order.AuthzURLs {
+		authz, err := m.client.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		chal, cleanup, err := m.solve(ctx, authz)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, cleanup)
+
+		if _, err := m.client.Accept(ctx, chal); err != nil {
+			return nil, nil, fmt.Errorf("accept %s challenge: %w", chal.Type, err)
+		}
+		if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, nil, fmt.Errorf("%s challenge: %w", chal.Type, err)
+		}
+	}
+
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, fmt.Errorf("wait for order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalize order: %w", err)
+	}
+
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	m.registered = true
+	return nil
+}
+
+// solve prepares the most preferred challenge of authz this agent can
+// answer and returns a function that withdraws it. With core coordination
+// the CA may reach any agent, so challenges are published through Core and
+// TLS-ALPN-01, whose certificate cannot be shared, is not used.
+func (m *Manager) solve(ctx context.Context, authz *acme.Authorization) (*acme.Challenge, func(), error) {
+	domain := authz.Identifier.Value
+	fleet := m.cfg.Coordination == CoordinationCore
+	for _, typ := range m.cfg.Challenges {
+		for _, chal := range authz.Challenges {
+			if chal.Type != typ {
+				continue
+			}
+			switch typ {
+			case ChallengeHTTP01:
+				keyAuth, err := m.client.HTTP01ChallengeResponse(chal.Token)
+				if err != nil {
+					return nil, nil, err
+				}
+				token := chal.Token
+				if fleet {
+					cleanup, err := m.publish(ctx, domain, typ, token, keyAuth, func(d *config.Domain) bool {
+						return d.SSL.ACMEHTTPChallenge == config.ACMEHTTPChallenge{Token: token, KeyAuthorization: keyAuth}
+					})
+					if err != nil {
+						return nil, nil, err
+					}
+					return chal, cleanup, nil
+				}
+				m.mu.Lock()
+				m.tokens[token] = keyAuth
+				m.mu.Unlock()
+				return chal, func() {
+					m.mu.Lock()
+					delete(m.tokens, token)
+					m.mu.Unlock()
+				}, nil
+			case ChallengeTLSALPN01:
+				if fleet {
+					continue
+				}
+				cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, domain)
+				if err != nil {
+					return nil, nil, err
+				}
+				m.mu.Lock()
+				m.alpnCerts[domain] = &cert
+				m.mu.Unlock()
+				return chal, func() {
+					m.mu.Lock()
+					delete(m.alpnCerts, domain)
+					m.mu.Unlock()
+				}, nil
+			case ChallengeDNS01:
+				if !fleet && m.dns == nil {
+					continue
+				}
+				value, err := m.client.DNS01ChallengeRecord(chal.Token)
+				if err != nil {
+					return nil, nil, err
+				}
+				if fleet {
+					cleanup, err := m.publish(ctx, domain, typ, "", value, func(d *config.Domain) bool {
+						for _, record := range d.DNSRecords {
+							if record.Name == "_acme-challenge" && record.Type == "TXT" && record.Value == value {
+								return true
+							}
+						}
+						return false
+					})
+					if err != nil {
+						return nil, nil, err
+					}
+					return chal, cleanup, nil
+				}
+				name := "_acme-challenge." + domain
+				m.dns.SetACMEChallenge(name, value)
+				return chal, func() { m.dns.ClearACMEChallenge(name, value) }, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("no usable challenge offered for %s", domain)
+}
+
+// publish hands a challenge to Core and waits until every agent serves it:
+// Core delivered it to this agent (published reports that) and the others
+// had PropagationWait to poll it as well.
+func (m *Manager) publish(ctx context.Context, domain, typ, token, value string, published func(*config.Domain) bool) (func(), error) {
+	if err := m.configMgr.PublishACMEChallenge(domain, typ, token, value); err != nil {
+		return nil, fmt.Errorf("publish %s challenge: %w", typ, err)
+	}
+	cleanup := func() {
+		if err := m.configMgr.RemoveACMEChallenge(domain, typ, token, value); err != nil {
+			log.Printf("[ACME] Error removing %s challenge of %s from Core: %v", typ, domain, err)
+		}
+	}
+
+	ticker := time.NewTicker(propagationCheck)
+	defer ticker.Stop()
+	for {
+		if d := m.configMgr.FindDomain(domain); d != nil && published(d) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			cleanup()
+			return nil, fmt.Errorf("%s challenge not delivered by Core: %w", typ, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		cleanup()
+		return nil, ctx.Err()
+	case <-time.After(m.cfg.PropagationWait):
+	}
+	return cleanup, nil
+}
+
+// HTTP01Response returns the key authorization for an HTTP-01 token of a
+// pending order.
+func (m *Manager) HTTP01Response(token string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keyAuth, ok := m.tokens[token]
+	return keyAuth, ok
+}
+
+// TLSALPNCertificate returns the challenge certificate for a TLS-ALPN-01
+// validation handshake.
+func (m *Manager) TLSALPNCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	if m == nil || len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]
+	return cert, ok
+}
+
+// Certificate returns the unexpired certificate this agent obtained for
+// domain.
+func (m *Manager) Certificate(domain string) (*tls.Certificate, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cert, ok := m.certs[strings.ToLower(domain)]
+	if !ok || time.Now().After(cert.Leaf.NotAfter) {
+		return nil, false
+	}
+	return cert, true
+}
+
+// Certificates returns the unexpired certificates this agent obtained.
+func (m *Manager) Certificates() []*tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var certs []*tls.Certificate
+	for _, cert := range m.certs {
+		if now.Before(cert.Leaf.NotAfter) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// newHTTPClient trusts the system roots plus caCertFile, if set.
+func newHTTPClient(caCertFile string) (*http.Client, error) {
+	if caCertFile == "" {
+		return http.DefaultClient, nil
+	}
+	data, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("acme CA certificate: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("acme CA certificate: no certificate found in %s", caCertFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
@@ -0,0 +1,326 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestManagerSolve(t *testing.T) {
+	authz := &acme.Authorization{
+		Identifier: acme.AuthzID{Type: "dns", Value: "example.com"},
+		Challenges: []*acme.Challenge{
+			{Type: ChallengeDNS01, Token: "dns-token"},
+			{Type: ChallengeTLSALPN01, Token: "alpn-token"},
+			{Type: ChallengeHTTP01, Token: "http-token"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		challenges []string
+		dns        bool
+		want       string
+	}{
+		{"preference order", nil, true, ChallengeHTTP01},
+		{"tls-alpn-01", []string{ChallengeTLSALPN01, ChallengeHTTP01}, false, ChallengeTLSALPN01},
+		{"dns-01", []string{ChallengeDNS01, ChallengeHTTP01}, true, ChallengeDNS01},
+		{"dns-01 without provider", []string{ChallengeDNS01, ChallengeHTTP01}, false, ChallengeHTTP01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Config{Challenges: tt.challenges, Coordination: CoordinationNone})
+			records := &fakeDNS{}
+			if tt.dns {
+				m.SetDNSProvider(records)
+			}
+
+			chal, cleanup, err := m.solve(context.Background(), authz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chal.Type != tt.want {
+				t.Fatalf("solve() chose %s, want %s", chal.Type, tt.want)
+			}
+
+			switch chal.Type {
+			case ChallengeHTTP01:
+				if keyAuth, ok := m.HTTP01Response("http-token"); !ok || !strings.HasPrefix(keyAuth, "http-token.") {
+					t.Errorf("HTTP01Response() = %q, %v", keyAuth, ok)
+				}
+			case ChallengeTLSALPN01:
+				hello := &tls.ClientHelloInfo{ServerName: "example.com", SupportedProtos: []string{ALPNProto}}
+				if _, ok := m.TLSALPNCertificate(hello); !ok {
+					t.Error("TLSALPNCertificate() found no challenge certificate")
+				}
+				hello.SupportedProtos = []string{"h2", "http/1.1"}
+				if _, ok := m.TLSALPNCertificate(hello); ok {
+					t.Error("TLSALPNCertificate() answered a normal handshake")
+				}
+			case ChallengeDNS01:
+				if len(records.set) != 1 || records.set[0] != "_acme-challenge.example.com" {
+					t.Errorf("TXT records = %v, want _acme-challenge.example.com", records.set)
+				}
+			}
+
+			cleanup()
+			if _, ok := m.HTTP01Response("http-token"); ok {
+				t.Error("HTTP-01 token still served after cleanup")
+			}
+			if len(records.set) != len(records.cleared) {
+				t.Errorf("TXT records %v not cleared", records.set)
+			}
+		})
+	}
+}
+
+// fakeCore serves the poll and ACME coordination endpoints, distributing
+// published challenges the way Core does.
+type fakeCore struct {
+	mu     sync.Mutex
+	domain config.Domain
+	lease  bool // whether the lease endpoint exists
+}
+
+func (c *fakeCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/api/agent/poll":
+		json.NewEncoder(w).Encode(config.PollResponse{Success: true, Domains: []config.Domain{c.domain}})
+	case "/api/agent/acme/challenge":
+		var req config.ACMEChallengeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.Type == ChallengeHTTP01 && req.Remove:
+			c.domain.SSL.ACMEHTTPChallenge = config.ACMEHTTPChallenge{}
+		case req.Type == ChallengeHTTP01:
+			c.domain.SSL.ACMEHTTPChallenge = config.ACMEHTTPChallenge{Token: req.Token, KeyAuthorization: req.Value}
+		case req.Remove:
+			c.domain.DNSRecords = nil
+		default:
+			c.domain.DNSRecords = []config.DNSRecord{{Name: "_acme-challenge", Type: "TXT", Value: req.Value}}
+		}
+	case "/api/agent/acme/lease":
+		if !c.lease {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(config.ACMELeaseResponse{Success: true, Granted: true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *fakeCore) current() config.Domain {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.domain
+}
+
+func newFleetManager(t *testing.T, core *fakeCore, cfg Config) *Manager {
+	t.Helper()
+	server := httptest.NewServer(core)
+	t.Cleanup(server.Close)
+
+	configMgr := config.NewConfigManager(server.URL, "agent", "key")
+	go configMgr.StartPolling(10 * time.Millisecond)
+
+	cfg.StorageDir = t.TempDir()
+	cfg.DirectoryURL = server.URL + "/directory"
+	m, err := NewManager(configMgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestManagerSolveFleet(t *testing.T) {
+	authz := &acme.Authorization{
+		Identifier: acme.AuthzID{Type: "dns", Value: "example.com"},
+		Challenges: []*acme.Challenge{
+			{Type: ChallengeDNS01, Token: "dns-token"},
+			{Type: ChallengeTLSALPN01, Token: "alpn-token"},
+			{Type: ChallengeHTTP01, Token: "http-token"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		challenges []string
+		want       string
+	}{
+		{"http-01", nil, ChallengeHTTP01},
+		{"tls-alpn-01 is not shared", []string{ChallengeTLSALPN01, ChallengeDNS01}, ChallengeDNS01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := &fakeCore{domain: config.Domain{Domain: "example.com"}}
+			m := newFleetManager(t, core, Config{Challenges: tt.challenges})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			chal, cleanup, err := m.solve(ctx, authz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chal.Type != tt.want {
+				t.Fatalf("solve() chose %s, want %s", chal.Type, tt.want)
+			}
+
+			published := core.current()
+			switch chal.Type {
+			case ChallengeHTTP01:
+				if published.SSL.ACMEHTTPChallenge.Token != "http-token" || !strings.HasPrefix(published.SSL.ACMEHTTPChallenge.KeyAuthorization, "http-token.") {
+					t.Errorf("Core got HTTP-01 challenge %+v", published.SSL.ACMEHTTPChallenge)
+				}
+			case ChallengeDNS01:
+				if len(published.DNSRecords) != 1 || published.DNSRecords[0].Value == "" {
+					t.Errorf("Core got TXT records %+v", published.DNSRecords)
+				}
+			}
+			if _, ok := m.HTTP01Response("http-token"); ok {
+				t.Error("HTTP-01 token answered locally instead of through Core")
+			}
+
+			cleanup()
+			if published := core.current(); published.SSL.ACMEHTTPChallenge.Token != "" || len(published.DNSRecords) != 0 {
+				t.Errorf("challenge not removed from Core: %+v", published)
+			}
+		})
+	}
+}
+
+func TestManagerRenewWithoutLeaseEndpoint(t *testing.T) {
+	core := &fakeCore{domain: config.Domain{Domain: "example.com"}}
+	m := newFleetManager(t, core, Config{})
+
+	// The order itself fails: the fake Core is no ACME directory
+	err := m.renew(context.Background(), "example.com")
+	if err == nil || strings.Contains(err.Error(), "lease") {
+		t.Fatalf("renew() error = %v, want an ACME error", err)
+	}
+	if m.cfg.Coordination != CoordinationNone {
+		t.Errorf("coordination = %q, want fallback to %q", m.cfg.Coordination, CoordinationNone)
+	}
+}
+
+func TestManagerExpiry(t *testing.T) {
+	m := newTestManager(t, Config{})
+	now := time.Now()
+
+	stored, storedKey := testCertificate(t, "example.com", now.Add(80*24*time.Hour))
+	if err := m.store.Save("example.com", stored, storedKey); err != nil {
+		t.Fatal(err)
+	}
+	fromCore, _ := testCertificate(t, "example.com", now.Add(10*24*time.Hour))
+
+	tests := []struct {
+		name   string
+		domain config.Domain
+		want   time.Duration
+		wantOK bool
+	}{
+		{"later stored certificate wins", config.Domain{Domain: "example.com", SSL: config.SSL{Certificate: string(fromCore)}}, 80 * 24 * time.Hour, true},
+		{"Core certificate", config.Domain{Domain: "example.net", SSL: config.SSL{Certificate: string(fromCore)}}, 10 * 24 * time.Hour, true},
+		{"no certificate", config.Domain{Domain: "example.org"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expiry, ok := m.expiry(&tt.domain)
+			if ok != tt.wantOK {
+				t.Fatalf("expiry() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && expiry.Sub(now).Round(time.Hour) != tt.want {
+				t.Errorf("expiry() in %s, want %s", expiry.Sub(now).Round(time.Hour), tt.want)
+			}
+		})
+	}
+}
+
+// TestPebble runs a full HTTP-01 order against a Pebble server. Start Pebble
+// with its default config and set ACME_TEST_DIRECTORY to its directory URL
+// and ACME_TEST_CA to pebble.minica.pem.
+func TestPebble(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		t.Skip("ACME_TEST_DIRECTORY not set")
+	}
+	domain := envOr("ACME_TEST_DOMAIN", "localhost")
+
+	m := newTestManager(t, Config{
+		DirectoryURL: directory,
+		CACertFile:   os.Getenv("ACME_TEST_CA"),
+		Challenges:   []string{ChallengeHTTP01},
+		Coordination: CoordinationNone,
+	})
+
+	listener, err := net.Listen("tcp", envOr("ACME_TEST_HTTP_ADDR", ":5002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyAuth, ok := m.HTTP01Response(strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, keyAuth)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := m.renew(ctx, domain); err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := m.Certificate(domain)
+	if !ok {
+		t.Fatal("no certificate after renew()")
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		t.Error(err)
+	}
+}
+
+func newTestManager(t *testing.T, cfg Config) *Manager {
+	t.Helper()
+	cfg.StorageDir = t.TempDir()
+	m, err := NewManager(config.NewConfigManager("", "", ""), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func envOr(key, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+type fakeDNS struct {
+	set, cleared []string
+}
+
+func (f *fakeDNS) SetACMEChallenge(name, value string)   { f.set = append(f.set, name) }
+func (f *fakeDNS) ClearACMEChallenge(name, value string) { f.cleared = append(f.cleared, name) }
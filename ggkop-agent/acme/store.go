@@ -0,0 +1,153 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store keeps the ACME account key and issued certificates on disk:
+//
+//	<dir>/account.key
+//	<dir>/certs/<domain>.crt   certificate chain, PEM
+//	<dir>/certs/<domain>.key   private key, PEM
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0700); err != nil {
+		return nil, fmt.Errorf("acme store: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// AccountKey loads the account key, creating it on first use.
+func (s *Store) AccountKey() (crypto.Signer, error) {
+	path := filepath.Join(s.dir, "account.key")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return parseKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Load returns the stored certificate of domain with its leaf parsed. A
+// missing certificate is reported as os.ErrNotExist.
+func (s *Store) Load(domain string) (*tls.Certificate, error) {
+	certFile, keyFile, err := s.paths(domain)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate for %s: %w", domain, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("load certificate for %s: %w", domain, err)
+		}
+	}
+	return &cert, nil
+}
+
+// Save writes the certificate chain and key of domain. The key is written
+// first, so a reader never sees a new certificate with the old key.
+func (s *Store) Save(domain string, certPEM, keyPEM []byte) error {
+	certFile, keyFile, err := s.paths(domain)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFile(certFile, certPEM, 0644)
+}
+
+func (s *Store) paths(domain string) (certFile, keyFile string, err error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+		return "", "", fmt.Errorf("invalid domain name %q", domain)
+	}
+	base := filepath.Join(s.dir, "certs", domain)
+	return base + ".crt", base + ".key", nil
+}
+
+// writeFile replaces path atomically.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
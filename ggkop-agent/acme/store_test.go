@@ -0,0 +1,82 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1, err := store.AccountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := store.AccountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key1.(*ecdsa.PrivateKey).Equal(key2) {
+		t.Error("AccountKey() created a new key instead of loading the stored one")
+	}
+
+	if _, err := store.Load("example.com"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load() of a missing certificate = %v, want ErrNotExist", err)
+	}
+
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := testCertificate(t, "example.com", notAfter)
+	if err := store.Save("Example.com.", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := store.Load("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("NotAfter = %s, want %s", cert.Leaf.NotAfter, notAfter)
+	}
+
+	for _, domain := range []string{"", "../etc/passwd", ".hidden", `a\b`} {
+		if err := store.Save(domain, certPEM, keyPEM); err == nil {
+			t.Errorf("Save(%q) succeeded, want an error", domain)
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for domain and its key.
+func testCertificate(t *testing.T, domain string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
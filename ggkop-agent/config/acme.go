@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrCoreUnsupported is returned when Core does not implement an agent API
+// endpoint (it answers 404).
+var ErrCoreUnsupported = errors.New("endpoint not supported by Core")
+
+// ACMELeaseRequest asks Core for the right to order a certificate for a
+// domain. Core grants one lease per domain across the fleet until it expires
+// or the holder uploads a certificate.
+type ACMELeaseRequest struct {
+	AgentID  string `json:"agentId"`
+	AgentKey string `json:"agentKey"`
+	Domain   string `json:"domain"`
+	TTL      int    `json:"ttl"` // seconds
+}
+
+type ACMELeaseResponse struct {
+	Success bool   `json:"success"`
+	Granted bool   `json:"granted"`
+	Holder  string `json:"holder"` // agent ID holding the lease
+}
+
+// CertificateUpload hands a certificate issued by the agent to Core, which
+// distributes it to the fleet in the poll response.
+type CertificateUpload struct {
+	AgentID     string `json:"agentId"`
+	AgentKey    string `json:"agentKey"`
+	Domain      string `json:"domain"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"privateKey"`
+}
+
+// ACMEChallengeRequest publishes (or, with Remove, withdraws) a challenge of
+// an order placed by the agent. Core serves it from every agent: HTTP-01 as
+// ssl.acmeHttpChallenge and DNS-01 as a _acme-challenge TXT record.
+type ACMEChallengeRequest struct {
+	AgentID  string `json:"agentId"`
+	AgentKey string `json:"agentKey"`
+	Domain   string `json:"domain"`
+	Type     string `json:"type"`  // "http-01" or "dns-01"
+	Token    string `json:"token"` // HTTP-01 only
+	Value    string `json:"value"` // HTTP-01 key authorization or DNS-01 TXT value
+	Remove   bool   `json:"remove"`
+}
+
+// AcquireACMELease asks Core whether this agent may order a certificate for
+// domain. It returns the agent holding the lease when it is not granted.
+func (cm *ConfigManager) AcquireACMELease(domain string, ttl time.Duration) (bool, string, error) {
+	var resp ACMELeaseResponse
+	err := cm.postCore("/api/agent/acme/lease", ACMELeaseRequest{
+		AgentID:  cm.agentID,
+		AgentKey: cm.agentKey,
+		Domain:   domain,
+		TTL:      int(ttl / time.Second),
+	}, &resp)
+	if err != nil {
+		return false, "", err
+	}
+	if !resp.Success {
+		return false, "", errors.New("core returned success=false")
+	}
+	return resp.Granted, resp.Holder, nil
+}
+
+// UploadCertificate sends a certificate and key, both PEM, to Core.
+func (cm *ConfigManager) UploadCertificate(domain, certPEM, keyPEM string) error {
+	return cm.postCore("/api/agent/acme/certificate", CertificateUpload{
+		AgentID:     cm.agentID,
+		AgentKey:    cm.agentKey,
+		Domain:      domain,
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}, nil)
+}
+
+// PublishACMEChallenge asks Core to serve a challenge from the whole fleet.
+func (cm *ConfigManager) PublishACMEChallenge(domain, typ, token, value string) error {
+	return cm.postACMEChallenge(domain, typ, token, value, false)
+}
+
+// RemoveACMEChallenge withdraws a challenge published with
+// PublishACMEChallenge.
+func (cm *ConfigManager) RemoveACMEChallenge(domain, typ, token, value string) error {
+	return cm.postACMEChallenge(domain, typ, token, value, true)
+}
+
+func (cm *ConfigManager) postACMEChallenge(domain, typ, token, value string, remove bool) error {
+	return cm.postCore("/api/agent/acme/challenge", ACMEChallengeRequest{
+		AgentID:  cm.agentID,
+		AgentKey: cm.agentKey,
+		Domain:   domain,
+		Type:     typ,
+		Token:    token,
+		Value:    value,
+		Remove:   remove,
+	}, nil)
+}
+
+// postCore sends body as JSON to an agent API endpoint of Core and decodes
+// the reply into out unless it is nil.
+func (cm *ConfigManager) postCore(path string, body, out interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", cm.coreURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cm.agentKey)
+
+	resp, err := cm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrCoreUnsupported
+	case resp.StatusCode != http.StatusOK:
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, data)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
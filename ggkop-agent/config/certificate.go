@@ -0,0 +1,239 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CertStore holds the certificates of all SSL domains, parsed once per
+// configuration revision and looked up by SNI name. Every name maps to a
+// list of candidates, ECDSA before RSA.
+type CertStore struct {
+	exact    map[string][]*tls.Certificate // certificate names
+	wildcard map[string][]*tls.Certificate // *.example.com keyed by example.com
+	domains  map[string][]*tls.Certificate // configured domain → its certificates
+	fallback []*tls.Certificate            // for unknown names and clients without SNI
+	certs    []*tls.Certificate            // every parsed certificate
+	infos    []CertificateInfo
+
+	fingerprints map[*tls.Certificate][32]byte // SHA-256 of the leaf
+}
+
+// CertificateInfo describes a configured certificate for the stats endpoint.
+type CertificateInfo struct {
+	Domain        string    `json:"domain"`
+	Names         []string  `json:"names,omitempty"`
+	KeyType       string    `json:"key_type,omitempty"` // ECDSA, RSA or Ed25519
+	NotAfter      time.Time `json:"not_after,omitempty"`
+	ExpiresInDays int       `json:"expires_in_days"`
+	Error         string    `json:"error,omitempty"`
+
+	OCSPNextUpdate *time.Time `json:"ocsp_next_update,omitempty"` // expiry of the stapled response
+
+	fingerprint [32]byte
+}
+
+// NewCertStore parses the certificates of domains with SSL enabled. The
+// certificates of defaultDomain, if any, are served for names without one.
+// Certificates that fail to parse are reported in Certificates.
+func NewCertStore(domains []Domain, defaultDomain string) *CertStore {
+	s := &CertStore{
+		exact:    make(map[string][]*tls.Certificate),
+		wildcard: make(map[string][]*tls.Certificate),
+		domains:  make(map[string][]*tls.Certificate),
+
+		fingerprints: make(map[*tls.Certificate][32]byte),
+	}
+
+	for _, domain := range domains {
+		if !domain.SSL.Enabled {
+			continue
+		}
+		name := normalizeName(domain.Domain)
+
+		pairs := domain.SSL.AdditionalCertificates
+		if domain.SSL.Certificate != "" || domain.SSL.PrivateKey != "" || len(pairs) == 0 {
+			pairs = append([]CertificatePair{{domain.SSL.Certificate, domain.SSL.PrivateKey}}, pairs...)
+		}
+		for _, pair := range pairs {
+			info := CertificateInfo{Domain: name}
+			cert, err := parseCertificate(pair)
+			if err != nil {
+				info.Error = err.Error()
+				s.infos = append(s.infos, info)
+				log.Printf("[Config] Certificate for %s not loaded: %v", name, err)
+				continue
+			}
+			info.Names = certificateNames(cert.Leaf)
+			info.KeyType = keyType(cert.Leaf)
+			info.NotAfter = cert.Leaf.NotAfter
+			info.fingerprint = sha256.Sum256(cert.Certificate[0])
+			s.infos = append(s.infos, info)
+
+			s.certs = append(s.certs, cert)
+			s.fingerprints[cert] = info.fingerprint
+			s.domains[name] = append(s.domains[name], cert)
+			for _, certName := range info.Names {
+				if parent, ok := strings.CutPrefix(certName, "*."); ok {
+					s.wildcard[parent] = append(s.wildcard[parent], cert)
+				} else {
+					s.exact[certName] = append(s.exact[certName], cert)
+				}
+			}
+		}
+	}
+
+	for _, index := range []map[string][]*tls.Certificate{s.exact, s.wildcard, s.domains} {
+		for _, certs := range index {
+			sort.SliceStable(certs, func(i, j int) bool { return keyRank(certs[i]) < keyRank(certs[j]) })
+		}
+	}
+	if defaultDomain != "" {
+		s.fallback = s.domains[normalizeName(defaultDomain)]
+	}
+	sort.SliceStable(s.infos, func(i, j int) bool { return s.infos[i].Domain < s.infos[j].Domain })
+	return s
+}
+
+// Lookup returns the certificate for the client: among the certificates
+// naming the SNI name exactly, then wildcards covering it, then the default
+// ones, it picks the first
+// the client supports (ECDSA before RSA). When the client supports none of
+// them the first is returned and the handshake decides.
+func (s *CertStore) Lookup(hello *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	candidates := s.candidates(normalizeName(hello.ServerName))
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	for _, cert := range candidates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, true
+		}
+	}
+	return candidates[0], true
+}
+
+func (s *CertStore) candidates(name string) []*tls.Certificate {
+	if name == "" {
+		return s.fallback
+	}
+	if certs, ok := s.exact[name]; ok {
+		return certs
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if certs, ok := s.wildcard[name[i+1:]]; ok {
+			return certs
+		}
+	}
+	return s.fallback
+}
+
+// Certificates returns the configured certificates with their remaining
+// validity, sorted by domain.
+func (s *CertStore) Certificates() []CertificateInfo {
+	now := time.Now()
+	infos := make([]CertificateInfo, len(s.infos))
+	copy(infos, s.infos)
+	for i := range infos {
+		if !infos[i].NotAfter.IsZero() {
+			infos[i].ExpiresInDays = int(infos[i].NotAfter.Sub(now).Hours() / 24)
+		}
+	}
+	return infos
+}
+
+// GetCertificate returns the TLS certificate for a client hello, with its
+// OCSP response stapled when one is known.
+func (cm *ConfigManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store := cm.certs.Load()
+	cert, ok := store.Lookup(hello)
+	if !ok {
+		return nil, errors.New("no certificate available")
+	}
+	return cm.staple(cert, store.fingerprints[cert]), nil
+}
+
+// Certificates returns the certificates of the current configuration.
+func (cm *ConfigManager) Certificates() []CertificateInfo {
+	infos := cm.certs.Load().Certificates()
+	for i := range infos {
+		if nextUpdate, ok := cm.ocspNextUpdate(infos[i].fingerprint); ok {
+			infos[i].OCSPNextUpdate = &nextUpdate
+		}
+	}
+	return infos
+}
+
+// SetDefaultCertificate selects the domain whose certificate is served to
+// clients asking for a name without one.
+func (cm *ConfigManager) SetDefaultCertificate(domain string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.defaultCertDomain = domain
+	cm.certs.Store(NewCertStore(cm.config.Domains, domain))
+}
+
+func parseCertificate(pair CertificatePair) (*tls.Certificate, error) {
+	if pair.Certificate == "" || pair.PrivateKey == "" {
+		return nil, errors.New("certificate or key missing")
+	}
+	cert, err := tls.X509KeyPair([]byte(pair.Certificate), []byte(pair.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("parse leaf: %w", err)
+	}
+	return &cert, nil
+}
+
+// certificateNames returns the DNS names a certificate is valid for, falling
+// back to the common name for certificates without SANs.
+func certificateNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		normalized = append(normalized, normalizeName(name))
+	}
+	return normalized
+}
+
+func keyType(leaf *x509.Certificate) string {
+	switch leaf.PublicKeyAlgorithm {
+	case x509.ECDSA:
+		return "ECDSA"
+	case x509.RSA:
+		return "RSA"
+	case x509.Ed25519:
+		return "Ed25519"
+	}
+	return leaf.PublicKeyAlgorithm.String()
+}
+
+// keyRank orders candidates: ECDSA is smaller and faster, RSA is the
+// compatible fallback.
+func keyRank(cert *tls.Certificate) int {
+	switch cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return 0
+	case *rsa.PrivateKey:
+		return 1
+	}
+	return 2
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCertStoreLookup(t *testing.T) {
+	domains := []Domain{
+		{Domain: "example.com", SSL: testSSL(t, "example.com", "*.example.com")},
+		{Domain: "example.net", SSL: testSSL(t, "example.net")},
+		{Domain: "api.example.com", SSL: testSSL(t, "api.example.com")},
+		{Domain: "broken.example", SSL: SSL{Enabled: true, Certificate: "junk", PrivateKey: "junk"}},
+		{Domain: "plain.example", SSL: SSL{Certificate: "unused"}},
+	}
+	store := NewCertStore(domains, "example.net")
+
+	tests := []struct {
+		serverName string
+		want       string // first name of the certificate served
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.com.", "example.com"},    // wildcard
+		{"api.example.com", "api.example.com"}, // exact beats wildcard
+		{"a.b.example.com", "example.net"},     // not covered by *.example.com
+		{"shop.example.net", "example.net"},    // default
+		{"unknown.example.org", "example.net"}, // default
+		{"", "example.net"},                    // no SNI
+		{"broken.example", "example.net"},      // unparsable certificate
+	}
+
+	for _, tt := range tests {
+		cert, ok := store.Lookup(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if !ok {
+			t.Errorf("Lookup(%q) found nothing, want %s", tt.serverName, tt.want)
+			continue
+		}
+		if got := cert.Leaf.DNSNames[0]; got != tt.want {
+			t.Errorf("Lookup(%q) = %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+
+	for _, serverName := range []string{"unknown.example.org", "a.b.example.com", "shop.example.net"} {
+		if _, ok := NewCertStore(domains, "").Lookup(&tls.ClientHelloInfo{ServerName: serverName}); ok {
+			t.Errorf("Lookup(%q) without a default certificate found one not covering the name", serverName)
+		}
+	}
+
+	infos := store.Certificates()
+	if len(infos) != 4 {
+		t.Fatalf("Certificates() = %d entries, want 4", len(infos))
+	}
+	if infos[0].Domain != "api.example.com" || infos[0].ExpiresInDays != 29 || infos[0].KeyType != "ECDSA" {
+		t.Errorf("Certificates()[0] = %+v, want api.example.com ECDSA expiring in 29 days", infos[0])
+	}
+	if infos[1].Domain != "broken.example" || infos[1].Error == "" {
+		t.Errorf("Certificates()[1] = %+v, want the parse error of broken.example", infos[1])
+	}
+}
+
+func TestCertStoreKeyType(t *testing.T) {
+	ssl := testSSL(t, "*.example.com")
+	ssl.Certificate, ssl.PrivateKey = "", ""
+	rsaCert := testPair(t, rsaKey(t), "*.example.com")
+	ecdsaCert := testPair(t, ecdsaKey(t), "*.example.com")
+	ssl.AdditionalCertificates = []CertificatePair{rsaCert, ecdsaCert}
+	store := NewCertStore([]Domain{{Domain: "example.com", SSL: ssl}}, "")
+
+	tests := []struct {
+		name    string
+		schemes []tls.SignatureScheme
+		want    x509.PublicKeyAlgorithm
+	}{
+		{"ECDSA preferred", []tls.SignatureScheme{tls.PSSWithSHA256, tls.ECDSAWithP256AndSHA256}, x509.ECDSA},
+		{"RSA-only client", []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}, x509.RSA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := &tls.ClientHelloInfo{
+				ServerName:        "www.example.com",
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				SignatureSchemes:  tt.schemes,
+			}
+			cert, ok := store.Lookup(hello)
+			if !ok {
+				t.Fatal("Lookup() found nothing")
+			}
+			if got := cert.Leaf.PublicKeyAlgorithm; got != tt.want {
+				t.Errorf("Lookup() served %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if n := len(store.Certificates()); n != 2 {
+		t.Errorf("Certificates() = %d entries, want 2 (no entry for the empty primary)", n)
+	}
+}
+
+// testSSL returns an enabled SSL config with a self-signed ECDSA certificate
+// for names, valid for 30 days.
+func testSSL(t *testing.T, names ...string) SSL {
+	pair := testPair(t, ecdsaKey(t), names...)
+	return SSL{Enabled: true, Certificate: pair.Certificate, PrivateKey: pair.PrivateKey}
+}
+
+func testPair(t *testing.T, key crypto.Signer, names ...string) CertificatePair {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CertificatePair{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func ecdsaKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func rsaKey(t *testing.T) crypto.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// GeoDNS map keys are normalized into one of these forms:
+//
+//	as13335       - autonomous system number
+//	us-ca         - ISO 3166-2 subdivision (country-region)
+//	us            - ISO 3166-1 alpha-2 country
+//	europe        - continent name as used by Core
+//	default       - fallback record
+//
+// Core "custom" locations are kept verbatim and only match when a client
+// resolves to exactly that key.
+//
+// A record name is a location only when Core lists it in geoDnsLocations or
+// it carries an explicit prefix (country:, region:, continent:, asn:).
+// Everything else, however much it looks like a location ("my-app", "asia",
+// "db"), is an ordinary record.
+
+// continentAliases maps Core continent names and MaxMind continent codes to
+// the canonical continent key.
+var continentAliases = map[string]string{
+	"europe":        "europe",
+	"north-america": "north-america",
+	"south-america": "south-america",
+	"asia":          "asia",
+	"africa":        "africa",
+	"oceania":       "oceania",
+	"antarctica":    "antarctica",
+	"eu":            "europe",
+	"na":            "north-america",
+	"sa":            "south-america",
+	"as":            "asia",
+	"af":            "africa",
+	"oc":            "oceania",
+	"an":            "antarctica",
+}
+
+// ContinentKey returns the canonical GeoDNS key for a continent name or
+// two-letter MaxMind continent code, or "" if it is not a known continent.
+func ContinentKey(code string) string {
+	return continentAliases[strings.ToLower(code)]
+}
+
+// ASNKey returns the canonical GeoDNS key for an autonomous system number.
+func ASNKey(asn uint) string {
+	return "as" + strconv.FormatUint(uint64(asn), 10)
+}
+
+// NormalizeGeoDNSKey converts a GeoDNS record name into its canonical map key.
+// locationType is the type Core reported for this code in geoDnsLocations
+// ("country", "region", "continent", "asn", "custom") and is empty for names
+// Core did not list. The second return value is false when the name is not a
+// GeoDNS location (e.g. "www").
+func NormalizeGeoDNSKey(name, locationType string) (string, bool) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if key == "" {
+		return "", false
+	}
+
+	// Explicit prefixes always win, so two-letter continent codes can be
+	// used without colliding with country codes ("continent:as" vs "as").
+	if rest, ok := strings.CutPrefix(key, "continent:"); ok {
+		if continent := ContinentKey(rest); continent != "" {
+			return continent, true
+		}
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(key, "asn:"); ok {
+		return parseASNKey("as" + strings.TrimPrefix(rest, "as"))
+	}
+	if rest, ok := strings.CutPrefix(key, "country:"); ok {
+		if isCountryCode(rest) {
+			return rest, true
+		}
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(key, "region:"); ok {
+		if isRegionCode(rest) {
+			return rest, true
+		}
+		return "", false
+	}
+
+	switch locationType {
+	case "country":
+		if isCountryCode(key) {
+			return key, true
+		}
+	case "region":
+		if isRegionCode(key) {
+			return key, true
+		}
+	case "continent":
+		if continent := ContinentKey(key); continent != "" {
+			return continent, true
+		}
+	case "asn":
+		return parseASNKey("as" + strings.TrimPrefix(key, "as"))
+	case "custom":
+		return key, true
+	}
+	return "", false
+}
+
+func parseASNKey(key string) (string, bool) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(key, "as"), 10, 32)
+	if err != nil || asn == 0 {
+		return "", false
+	}
+	return ASNKey(uint(asn)), true
+}
+
+// isCountryCode reports whether name looks like an ISO 3166-1 alpha-2 code.
+func isCountryCode(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	return isLetter(name[0]) && isLetter(name[1])
+}
+
+// isRegionCode reports whether name looks like an ISO 3166-2 subdivision code
+// such as "us-ca" or "gb-eng".
+func isRegionCode(name string) bool {
+	country, sub, ok := strings.Cut(name, "-")
+	if !ok || !isCountryCode(country) || len(sub) == 0 || len(sub) > 3 {
+		return false
+	}
+	for i := 0; i < len(sub); i++ {
+		if !isLetter(sub[i]) && !(sub[i] >= '0' && sub[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpdateConfigGeoDNSRecords(t *testing.T) {
+	cm := NewConfigManager("", "", "")
+	cm.updateConfig(PollResponse{Domains: []Domain{{
+		Domain: "example.com",
+		DNSRecords: []DNSRecord{
+			{Name: "@", Type: "A", Value: "192.0.2.1"},
+			{Name: "my-app", Type: "A", Value: "192.0.2.2"},
+			{Name: "europe", Type: "A", Value: "192.0.2.3"},
+			{Name: "db", Type: "A", Value: "192.0.2.4"},
+			{Name: "de", Type: "A", Value: "192.0.2.5"},
+			{Name: "continent:asia", Type: "A", Value: "192.0.2.6"},
+		},
+		GeoDNSLocations: []GeoDNSLocation{{Code: "de", Type: "country"}},
+	}}})
+
+	domain := cm.GetDomain("example.com")
+	var names []string
+	for _, record := range domain.DNSRecords {
+		names = append(names, record.Name)
+	}
+	if want := []string{"@", "my-app", "europe", "db"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("regular records = %v, want %v", names, want)
+	}
+	want := map[string]string{"default": "192.0.2.1", "de": "192.0.2.5", "asia": "192.0.2.6"}
+	if !reflect.DeepEqual(domain.GeoDNSMap, want) {
+		t.Errorf("GeoDNSMap = %v, want %v", domain.GeoDNSMap, want)
+	}
+}
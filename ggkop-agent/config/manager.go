@@ -3,6 +3,7 @@ package config
 import (
 	"bytes"
 	"encoding/json"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +23,14 @@ type ConfigManager struct {
 	mu       sync.RWMutex
 	client   *http.Client
 	stats    Stats
+	hash     uint64 // hash of the last applied poll response
+
+	certs             atomic.Pointer[CertStore] // rebuilt when the revision changes
+	defaultCertDomain string
+	ocsp              ocspCache
+
+	listenersMu sync.RWMutex
+	listeners   []func(*Config)
 }
 
 type Stats struct {
@@ -33,7 +43,7 @@ type Stats struct {
 }
 
 func NewConfigManager(coreURL, agentID, agentKey string) *ConfigManager {
-	return &ConfigManager{
+	cm := &ConfigManager{
 		coreURL:  coreURL,
 		agentID:  agentID,
 		agentKey: agentKey,
@@ -45,6 +55,8 @@ func NewConfigManager(coreURL, agentID, agentKey string) *ConfigManager {
 			Timeout: 30 * time.Second,
 		},
 	}
+	cm.certs.Store(NewCertStore(nil, ""))
+	return cm
 }
 
 func (cm *ConfigManager) StartPolling(interval time.Duration) {
@@ -117,6 +129,7 @@ func (cm *ConfigManager) poll() {
 
 	cm.updateConfig(pollResp)
 	cm.recordSuccessfulPoll()
+	cm.notifyListeners()
 
 	log.Printf("[Poll] Configuration updated successfully: %d domains, %d proxies",
 		len(pollResp.Domains), len(pollResp.Proxies))
@@ -139,20 +152,6 @@ func (cm *ConfigManager) updateConfig(resp PollResponse) {
 		return parsedIP.To4() != nil
 	}
 
-	// Helper function to check if a name is a valid ISO 3166-1 alpha-2 country code
-	isCountryCode := func(name string) bool {
-		if len(name) != 2 {
-			return false
-		}
-		// Check if both characters are letters (uppercase or lowercase)
-		for _, c := range name {
-			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
-				return false
-			}
-		}
-		return true
-	}
-
 	// Convert DNS records with location names to GeoDNS map
 	for i := range resp.Domains {
 		domain := &resp.Domains[i]
@@ -162,6 +161,12 @@ func (cm *ConfigManager) updateConfig(resp PollResponse) {
 			domain.GeoDNSMap = make(map[string]string)
 		}
 
+		// Location types reported by Core, used to disambiguate record names
+		locationTypes := make(map[string]string, len(domain.GeoDNSLocations))
+		for _, location := range domain.GeoDNSLocations {
+			locationTypes[strings.ToLower(location.Code)] = location.Type
+		}
+
 		// Separate regular DNS records from GeoDNS records
 		regularRecords := []DNSRecord{}
 		hasHTTPProxyEnabled := false
@@ -174,16 +179,14 @@ func (cm *ConfigManager) updateConfig(resp PollResponse) {
 			if record.Type == "A" {
 				recordName := record.Name
 
-				// Check if this is a GeoDNS location record (ISO 3166-1 alpha-2 country code)
-				if isCountryCode(recordName) {
+				// Check if this is a GeoDNS location record (country, region, continent, ASN)
+				if geoKey, ok := NormalizeGeoDNSKey(recordName, locationTypes[strings.ToLower(recordName)]); ok {
 					// Validate IP address before adding to GeoDNS map
 					if !isValidIPv4(record.Value) {
 						log.Printf("[Config] WARNING: Invalid IPv4 address for GeoDNS %s: %s - skipping", recordName, record.Value)
 						continue
 					}
-					// Store in lowercase for consistent GeoDNS lookups
-					countryCode := strings.ToLower(recordName)
-					domain.GeoDNSMap[countryCode] = record.Value
+					domain.GeoDNSMap[geoKey] = record.Value
 				} else if recordName == "@" || recordName == "" || recordName == domain.Domain {
 					// This is the default record
 					if !isValidIPv4(record.Value) {
@@ -221,7 +224,13 @@ func (cm *ConfigManager) updateConfig(resp PollResponse) {
 
 	cm.config.Domains = resp.Domains
 	cm.config.Proxies = resp.Proxies
+	cm.config.GeoIPOverrides = resp.GeoIPOverrides
 	cm.config.LastUpdate = time.Now()
+	if hash := hashPollResponse(resp); hash != cm.hash {
+		cm.hash = hash
+		cm.config.Revision++
+		cm.certs.Store(NewCertStore(cm.config.Domains, cm.defaultCertDomain))
+	}
 
 	cm.stats.mu.Lock()
 	cm.stats.DomainsLoaded = len(resp.Domains)
@@ -265,6 +274,40 @@ func (cm *ConfigManager) updateConfig(resp PollResponse) {
 	}
 }
 
+// OnUpdate registers fn to be called after every successful configuration
+// update. Listeners run synchronously on the polling goroutine and must not
+// block.
+func (cm *ConfigManager) OnUpdate(fn func(*Config)) {
+	cm.listenersMu.Lock()
+	cm.listeners = append(cm.listeners, fn)
+	cm.listenersMu.Unlock()
+}
+
+func (cm *ConfigManager) notifyListeners() {
+	cfg := cm.GetConfig()
+
+	cm.listenersMu.RLock()
+	listeners := make([]func(*Config), len(cm.listeners))
+	copy(listeners, cm.listeners)
+	cm.listenersMu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(cfg)
+	}
+}
+
+// hashPollResponse fingerprints the polled content so listeners can tell a
+// real change from a poll that returned the same configuration.
+func hashPollResponse(resp PollResponse) uint64 {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
 func (cm *ConfigManager) recordSuccessfulPoll() {
 	cm.stats.mu.Lock()
 	cm.stats.LastPollTime = time.Now()
@@ -289,6 +332,23 @@ func (cm *ConfigManager) GetDomain(domain string) *Domain {
 	return nil
 }
 
+// FindDomain returns the configured domain host belongs to: host itself or
+// its closest configured parent, so www.example.co.uk finds example.co.uk.
+func (cm *ConfigManager) FindDomain(host string) *Domain {
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	for name != "" {
+		if domainConfig := cm.GetDomain(name); domainConfig != nil {
+			return domainConfig
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil
+}
+
 func (cm *ConfigManager) GetAllDomains() []Domain {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
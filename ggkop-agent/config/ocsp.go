@@ -0,0 +1,266 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspRetryDelay    = 5 * time.Minute
+	ocspDefaultMaxAge = time.Hour // for responses without a nextUpdate
+	ocspMaxResponse   = 1 << 20
+)
+
+var (
+	errNoOCSPServer = errors.New("certificate has no OCSP server")
+
+	defaultOCSPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// ocspCache holds the stapled OCSP responses by leaf fingerprint, so they
+// survive certificate store rebuilds.
+type ocspCache struct {
+	mu      sync.RWMutex
+	staples map[[32]byte]ocspStaple
+	client  *http.Client              // defaultOCSPClient when nil
+	source  func() []*tls.Certificate // certificates served besides the configured ones
+
+	cancel context.CancelFunc // stops the refresh loop and its requests
+	done   chan struct{}
+}
+
+type ocspStaple struct {
+	raw        []byte // nil while no good response is known
+	nextUpdate time.Time
+	refreshAt  time.Time
+}
+
+// SetOCSPSource adds the certificates returned by source, e.g. those the
+// agent obtained through ACME, to the ones kept stapled. Serve them through
+// Staple.
+func (cm *ConfigManager) SetOCSPSource(source func() []*tls.Certificate) {
+	cm.ocsp.mu.Lock()
+	defer cm.ocsp.mu.Unlock()
+	cm.ocsp.source = source
+}
+
+// StartOCSPStapling fetches OCSP responses for the served certificates in
+// the background and refreshes them halfway through their validity. It
+// checks every interval and after every configuration update until
+// StopOCSPStapling.
+func (cm *ConfigManager) StartOCSPStapling(interval time.Duration) {
+	wake := make(chan struct{}, 1)
+	cm.OnUpdate(func(*Config) {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cm.ocsp.cancel = cancel
+	cm.ocsp.done = make(chan struct{})
+
+	go func() {
+		defer close(cm.ocsp.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			cm.refreshOCSP(ctx, time.Now())
+			select {
+			case <-ticker.C:
+			case <-wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// StopOCSPStapling ends the refresh loop, aborting a running fetch, and
+// waits for it to return.
+func (cm *ConfigManager) StopOCSPStapling(ctx context.Context) error {
+	if cm.ocsp.cancel == nil {
+		return nil
+	}
+	cm.ocsp.cancel()
+	select {
+	case <-cm.ocsp.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refreshOCSP fetches the responses that are missing or due and drops those
+// of certificates no longer served. It gives up when ctx is cancelled.
+func (cm *ConfigManager) refreshOCSP(ctx context.Context, now time.Time) {
+	store := cm.certs.Load()
+	certs := make(map[[32]byte]*tls.Certificate)
+	for _, cert := range store.certs {
+		certs[store.fingerprints[cert]] = cert
+	}
+	cm.ocsp.mu.RLock()
+	source := cm.ocsp.source
+	cm.ocsp.mu.RUnlock()
+	if source != nil {
+		for _, cert := range source() {
+			certs[sha256.Sum256(cert.Certificate[0])] = cert
+		}
+	}
+
+	for key, cert := range certs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		cm.ocsp.mu.RLock()
+		staple, ok := cm.ocsp.staples[key]
+		cm.ocsp.mu.RUnlock()
+		if ok && now.Before(staple.refreshAt) {
+			continue
+		}
+
+		raw, resp, err := cm.ocsp.fetch(ctx, cert)
+		if errors.Is(err, errNoOCSPServer) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[OCSP] Error fetching response for %s (retrying in %s): %v", strings.Join(certificateNames(cert.Leaf), ","), ocspRetryDelay, err)
+			// Keep serving the previous response while it is valid
+			if !now.Before(staple.nextUpdate) {
+				staple.raw = nil
+			}
+			staple.refreshAt = now.Add(ocspRetryDelay)
+		} else {
+			staple = ocspStaple{raw: raw, nextUpdate: resp.NextUpdate}
+			if resp.NextUpdate.IsZero() {
+				staple.nextUpdate = now.Add(ocspDefaultMaxAge)
+			}
+			staple.refreshAt = resp.ThisUpdate.Add(staple.nextUpdate.Sub(resp.ThisUpdate) / 2)
+			if staple.refreshAt.Before(now.Add(ocspRetryDelay)) {
+				staple.refreshAt = now.Add(ocspRetryDelay)
+			}
+		}
+
+		cm.ocsp.mu.Lock()
+		if cm.ocsp.staples == nil {
+			cm.ocsp.staples = make(map[[32]byte]ocspStaple)
+		}
+		cm.ocsp.staples[key] = staple
+		cm.ocsp.mu.Unlock()
+	}
+
+	cm.ocsp.mu.Lock()
+	for key := range cm.ocsp.staples {
+		if _, ok := certs[key]; !ok {
+			delete(cm.ocsp.staples, key)
+		}
+	}
+	cm.ocsp.mu.Unlock()
+}
+
+// fetch queries the OCSP responder of cert. Only a signed "good" response
+// is returned.
+func (c *ocspCache) fetch(ctx context.Context, cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errNoOCSPServer
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("chain has no issuer certificate")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse issuer: %w", err)
+	}
+
+	request, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	client := c.client
+	if client == nil {
+		client = defaultOCSPClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder returned status %d", httpResp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return raw, resp, nil
+	case ocsp.Revoked:
+		return nil, nil, fmt.Errorf("certificate revoked at %s", resp.RevokedAt.Format(time.RFC3339))
+	default:
+		return nil, nil, errors.New("certificate status unknown to the responder")
+	}
+}
+
+// Staple attaches the OCSP response to a certificate of the OCSP source.
+func (cm *ConfigManager) Staple(cert *tls.Certificate) *tls.Certificate {
+	return cm.staple(cert, sha256.Sum256(cert.Certificate[0]))
+}
+
+// staple returns cert with its OCSP response attached, if one is valid.
+// Stored certificates are shared, so the staple goes on a copy.
+func (cm *ConfigManager) staple(cert *tls.Certificate, fingerprint [32]byte) *tls.Certificate {
+	cm.ocsp.mu.RLock()
+	staple, ok := cm.ocsp.staples[fingerprint]
+	cm.ocsp.mu.RUnlock()
+	if !ok || staple.raw == nil || !time.Now().Before(staple.nextUpdate) {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = staple.raw
+	return &stapled
+}
+
+// ocspNextUpdate returns when the stapled response for a leaf expires.
+func (cm *ConfigManager) ocspNextUpdate(fingerprint [32]byte) (time.Time, bool) {
+	cm.ocsp.mu.RLock()
+	defer cm.ocsp.mu.RUnlock()
+	staple, ok := cm.ocsp.staples[fingerprint]
+	if !ok || staple.raw == nil {
+		return time.Time{}, false
+	}
+	return staple.nextUpdate, true
+}
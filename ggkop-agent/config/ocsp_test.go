@@ -0,0 +1,215 @@
+package config
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapling(t *testing.T) {
+	ca, caKey := testCA(t)
+	responder := newTestResponder(t, ca, caKey)
+
+	cm := NewConfigManager("", "", "")
+	cm.updateConfig(PollResponse{Domains: []Domain{
+		{Domain: "example.com", SSL: testIssuedSSL(t, ca, caKey, responder.URL, "example.com")},
+		{Domain: "example.net", SSL: testSSL(t, "example.net")}, // no OCSP server
+	}})
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+
+	now := time.Now()
+	cm.refreshOCSP(context.Background(), now)
+	cert, err := cm.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ocsp.ParseResponse(cert.OCSPStaple, ca)
+	if err != nil {
+		t.Fatalf("stapled response: %v", err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("stapled status = %d, want good", resp.Status)
+	}
+	if infos := cm.Certificates(); infos[0].OCSPNextUpdate == nil || infos[1].OCSPNextUpdate != nil {
+		t.Errorf("OCSPNextUpdate = %v, %v; want only example.com stapled", infos[0].OCSPNextUpdate, infos[1].OCSPNextUpdate)
+	}
+
+	// Not due yet: no new request
+	cm.refreshOCSP(context.Background(), now.Add(time.Minute))
+	if n := responder.requests.Load(); n != 1 {
+		t.Errorf("responder got %d requests, want 1", n)
+	}
+
+	// A revoked certificate loses its staple once the old response expires
+	responder.status.Store(ocsp.Revoked)
+	cm.refreshOCSP(context.Background(), now.Add(2*time.Hour))
+	if cert, _ := cm.GetCertificate(hello); cert.OCSPStaple != nil {
+		t.Error("certificate still stapled after its response expired")
+	}
+}
+
+func TestOCSPStaplingSource(t *testing.T) {
+	ca, caKey := testCA(t)
+	responder := newTestResponder(t, ca, caKey)
+
+	ssl := testIssuedSSL(t, ca, caKey, responder.URL, "acme.example.com")
+	cert, err := parseCertificate(CertificatePair{ssl.Certificate, ssl.PrivateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewConfigManager("", "", "")
+	cm.SetOCSPSource(func() []*tls.Certificate { return []*tls.Certificate{cert} })
+	cm.StartOCSPStapling(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); cm.Staple(cert).OCSPStaple == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate from the OCSP source not stapled")
+		}
+	}
+	if cert.OCSPStaple != nil {
+		t.Error("Staple() modified the shared certificate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cm.StopOCSPStapling(ctx); err != nil {
+		t.Errorf("StopOCSPStapling() = %v", err)
+	}
+}
+
+func TestStopOCSPStaplingAbortsFetch(t *testing.T) {
+	ca, caKey := testCA(t)
+	started := make(chan struct{}, 1)
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.ReadAll(req.Body) // so the server notices the client going away
+		started <- struct{}{}
+		<-req.Context().Done()
+	}))
+	defer hanging.Close()
+
+	cm := NewConfigManager("", "", "")
+	cm.updateConfig(PollResponse{Domains: []Domain{
+		{Domain: "example.com", SSL: testIssuedSSL(t, ca, caKey, hanging.URL, "example.com")},
+	}})
+	cm.StartOCSPStapling(time.Hour)
+	<-started
+
+	// Well within the client timeout, so only cancellation can end the fetch
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cm.StopOCSPStapling(ctx); err != nil {
+		t.Errorf("StopOCSPStapling() = %v, want the hanging fetch aborted", err)
+	}
+	if cm.Certificates()[0].OCSPNextUpdate != nil {
+		t.Error("aborted fetch stored a response")
+	}
+}
+
+// testResponder is a local OCSP responder answering for every serial with
+// the configured status, signed by the CA itself.
+type testResponder struct {
+	*httptest.Server
+	status   atomic.Int64
+	requests atomic.Int64
+}
+
+func newTestResponder(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *testResponder {
+	t.Helper()
+	r := &testResponder{}
+	r.status.Store(ocsp.Good)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Add(1)
+		body, _ := io.ReadAll(req.Body)
+		ocspReq, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       int(r.status.Load()),
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now.Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key := ecdsaKey(t).(*ecdsa.PrivateKey)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// testIssuedSSL returns an SSL config with a certificate issued by ca,
+// pointing at ocspServer, and the CA in the chain.
+func testIssuedSSL(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ocspServer string, names ...string) SSL {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		OCSPServer:   []string{ocspServer},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	return SSL{
+		Enabled:     true,
+		Certificate: string(chain),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+}
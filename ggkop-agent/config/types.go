@@ -5,18 +5,27 @@ import (
 )
 
 type Config struct {
-	Domains    []Domain `json:"domains"`
-	Proxies    []Proxy  `json:"proxies"`
-	LastUpdate time.Time
+	Domains        []Domain        `json:"domains"`
+	Proxies        []Proxy         `json:"proxies"`
+	GeoIPOverrides []GeoIPOverride `json:"geoIpOverrides"`
+	LastUpdate     time.Time
+	Revision       uint64 // incremented whenever the polled content changes
 }
 
 type Domain struct {
-	Domain     string            `json:"domain"`
-	DNSRecords []DNSRecord       `json:"dnsRecords"`
-	GeoDNSMap  map[string]string `json:"geoDnsMap"`
-	HTTPProxy  HTTPProxy         `json:"httpProxy"`
-	SSL        SSL               `json:"ssl"`
-	LuaCode    string            `json:"luaCode"`
+	Domain          string            `json:"domain"`
+	DNSRecords      []DNSRecord       `json:"dnsRecords"`
+	GeoDNSMap       map[string]string `json:"geoDnsMap"`
+	GeoDNSLocations []GeoDNSLocation  `json:"geoDnsLocations"`
+	HTTPProxy       HTTPProxy         `json:"httpProxy"`
+	SSL             SSL               `json:"ssl"`
+	LuaCode         string            `json:"luaCode"`
+}
+
+type GeoDNSLocation struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Type string `json:"type"` // country, continent, custom
 }
 
 type DNSRecord struct {
@@ -31,6 +40,51 @@ type DNSRecord struct {
 type HTTPProxy struct {
 	Type    string `json:"type"`
 	Enabled bool   `json:"enabled"`
+	Origin  Origin `json:"origin"`
+
+	LoadBalancing LoadBalancing `json:"loadBalancing"`
+	Routes        []RouteRule   `json:"routes"`
+}
+
+// RouteRule sends matching requests to its own upstreams and rewrites them.
+// Rules are tried in order after the WAF; all set matchers must match.
+type RouteRule struct {
+	PathPrefix string            `json:"pathPrefix"`
+	PathRegex  string            `json:"pathRegex"`
+	Methods    []string          `json:"methods"`
+	Headers    map[string]string `json:"headers"` // value must equal; "" only requires presence
+
+	Upstreams   []string `json:"upstreams"`   // empty keeps the host's upstreams
+	StripPrefix bool     `json:"stripPrefix"` // remove the matched pathPrefix
+	RewritePath string   `json:"rewritePath"` // replaces the matched prefix, or the pathRegex match ($1 expands)
+
+	RequestHeaders  HeaderRules `json:"requestHeaders"`
+	ResponseHeaders HeaderRules `json:"responseHeaders"`
+}
+
+// HeaderRules adds (replacing existing values) and removes headers.
+type HeaderRules struct {
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+// LoadBalancing selects among a domain's upstreams and ejects failing ones.
+type LoadBalancing struct {
+	Algorithm   string `json:"algorithm"`   // round_robin (default), least_conn, ip_hash or cookie_hash
+	Cookie      string `json:"cookie"`      // cookie hashed by cookie_hash
+	MaxFails    int    `json:"maxFails"`    // consecutive errors before ejection, default 3
+	FailTimeout int    `json:"failTimeout"` // seconds an ejected upstream sits out, default 30
+	Retries     int    `json:"retries"`     // extra upstreams tried for idempotent requests, default 2
+}
+
+// Origin describes how the proxy connects to a domain's backend.
+type Origin struct {
+	Scheme     string `json:"scheme"`     // http (default), https or h2
+	Port       int    `json:"port"`       // used when the record value has no port
+	SNI        string `json:"sni"`        // TLS server name, defaults to HostHeader or the requested host
+	HostHeader string `json:"hostHeader"` // Host header sent to the origin
+	Verify     string `json:"verify"`     // verify (default), skip or pinned
+	CACert     string `json:"caCert"`     // PEM CA bundle for verify=pinned
 }
 
 type SSL struct {
@@ -38,6 +92,59 @@ type SSL struct {
 	Certificate string `json:"certificate"`
 	PrivateKey  string `json:"privateKey"`
 	AutoRenew   bool   `json:"autoRenew"`
+	HSTS        HSTS   `json:"hsts"`
+
+	// AdditionalCertificates are served alongside Certificate, e.g. an RSA
+	// certificate for clients that cannot verify the primary ECDSA one.
+	AdditionalCertificates []CertificatePair `json:"additionalCertificates"`
+
+	TLS TLSPolicy `json:"tls"`
+
+	ACMEHTTPChallenge ACMEHTTPChallenge `json:"acmeHttpChallenge"`
+}
+
+// TLSPolicy overrides the HTTPS handshake settings for a domain and its
+// subdomains. Empty fields keep the agent defaults.
+type TLSPolicy struct {
+	MinVersion   string     `json:"minVersion"`   // "1.0" to "1.3", default "1.2"
+	MaxVersion   string     `json:"maxVersion"`   // default "1.3"
+	CipherSuites []string   `json:"cipherSuites"` // IANA names, TLS 1.0-1.2 only
+	ALPN         []string   `json:"alpn"`         // "h2" and/or "http/1.1"
+	ClientAuth   ClientAuth `json:"clientAuth"`
+}
+
+// ClientAuth enables mutual TLS: client certificates are verified against
+// CACert and the verified identity is forwarded to the origin.
+type ClientAuth struct {
+	Mode   string `json:"mode"`   // "" (off), "optional" or "require"
+	CACert string `json:"caCert"` // PEM bundle
+}
+
+// CertificatePair is a PEM certificate chain with its private key.
+type CertificatePair struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"privateKey"`
+}
+
+// ACMEHTTPChallenge is a pending HTTP-01 challenge of an order placed by Core.
+type ACMEHTTPChallenge struct {
+	Token            string `json:"token"`
+	KeyAuthorization string `json:"keyAuthorization"`
+}
+
+// HSTS is the Strict-Transport-Security policy sent on HTTPS responses.
+type HSTS struct {
+	Enabled           bool `json:"enabled"`
+	MaxAge            int  `json:"maxAge"` // seconds, default one year
+	IncludeSubDomains bool `json:"includeSubDomains"`
+	Preload           bool `json:"preload"`
+}
+
+// GeoIPOverride pins a CIDR range to a GeoDNS location key
+// (country, region, continent, ASN or custom name).
+type GeoIPOverride struct {
+	CIDR     string `json:"cidr"`
+	Location string `json:"location"`
 }
 
 type Proxy struct {
@@ -56,7 +163,8 @@ type PollRequest struct {
 }
 
 type PollResponse struct {
-	Success bool     `json:"success"`
-	Domains []Domain `json:"domains"`
-	Proxies []Proxy  `json:"proxies"`
+	Success        bool            `json:"success"`
+	Domains        []Domain        `json:"domains"`
+	Proxies        []Proxy         `json:"proxies"`
+	GeoIPOverrides []GeoIPOverride `json:"geoIpOverrides"`
 }
@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// acmeChallengeTTL is short so resolvers do not keep a stale challenge.
+const acmeChallengeTTL = 60
+
+// acmeChallenges holds the TXT records of pending ACME DNS-01 challenges.
+type acmeChallenges struct {
+	mu      sync.RWMutex
+	records map[string][]string
+}
+
+// SetACMEChallenge publishes a DNS-01 TXT record for name, e.g.
+// _acme-challenge.example.com.
+func (s *DNSServer) SetACMEChallenge(name, value string) {
+	name = cleanDomain(name)
+	s.challenges.mu.Lock()
+	if s.challenges.records == nil {
+		s.challenges.records = make(map[string][]string)
+	}
+	s.challenges.records[name] = append(s.challenges.records[name], value)
+	s.challenges.mu.Unlock()
+	s.cache.Purge()
+}
+
+// ClearACMEChallenge withdraws a record added by SetACMEChallenge.
+func (s *DNSServer) ClearACMEChallenge(name, value string) {
+	name = cleanDomain(name)
+	s.challenges.mu.Lock()
+	values := s.challenges.records[name]
+	for i, v := range values {
+		if v == value {
+			values = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	if len(values) == 0 {
+		delete(s.challenges.records, name)
+	} else {
+		s.challenges.records[name] = values
+	}
+	s.challenges.mu.Unlock()
+	s.cache.Purge()
+}
+
+// acmeChallengeResponse answers TXT queries for names with a pending
+// challenge.
+func (s *DNSServer) acmeChallengeResponse(r *dns.Msg, domain string) (*dns.Msg, bool) {
+	question := r.Question[0]
+	if question.Qtype != dns.TypeTXT || !strings.HasPrefix(domain, "_acme-challenge.") {
+		return nil, false
+	}
+
+	s.challenges.mu.RLock()
+	values := s.challenges.records[domain]
+	s.challenges.mu.RUnlock()
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	for _, value := range values {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: acmeChallengeTTL},
+			Txt: []string{value},
+		})
+	}
+	return msg, true
+}
@@ -0,0 +1,42 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/ggkop/agent/config"
+	"github.com/miekg/dns"
+)
+
+func TestACMEChallenge(t *testing.T) {
+	server := &DNSServer{
+		configMgr: config.NewConfigManager("", "", ""),
+		cache:     NewDNSCache(10),
+		zones:     NewZoneStore(),
+		stats:     &DNSStats{},
+	}
+
+	query := func(qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("_ACME-Challenge.example.com.", qtype)
+		msg, _, _ := server.resolve(r, cleanDomain(r.Question[0].Name), "192.0.2.1")
+		return msg
+	}
+
+	server.SetACMEChallenge("_acme-challenge.example.com", "first")
+	server.SetACMEChallenge("_acme-challenge.example.com.", "second")
+	if msg := query(dns.TypeTXT); len(msg.Answer) != 2 || msg.Answer[0].(*dns.TXT).Txt[0] != "first" {
+		t.Fatalf("TXT answer = %v, want both challenge records", msg.Answer)
+	}
+	if msg := query(dns.TypeA); len(msg.Answer) != 0 {
+		t.Errorf("A answer = %v, want none", msg.Answer)
+	}
+
+	server.ClearACMEChallenge("_acme-challenge.example.com", "first")
+	if msg := query(dns.TypeTXT); len(msg.Answer) != 1 || msg.Answer[0].(*dns.TXT).Txt[0] != "second" {
+		t.Errorf("TXT answer = %v, want the second record only", msg.Answer)
+	}
+	server.ClearACMEChallenge("_acme-challenge.example.com", "second")
+	if msg := query(dns.TypeTXT); msg.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s after clearing, want NXDOMAIN", dns.RcodeToString[msg.Rcode])
+	}
+}
@@ -3,77 +3,134 @@ package dns
 import (
 	"sync"
 	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// negativeCacheTTL is used for NXDOMAIN and empty answers.
+	negativeCacheTTL = 60 * time.Second
+	// maxCacheTTL caps how long any answer is served from cache, so GeoIP
+	// database or override changes are picked up without a config swap.
+	maxCacheTTL = 5 * time.Minute
 )
 
+// DNSCache holds packed responses keyed by (qname, qtype, client location).
+// Entries are evicted least-recently-used once maxSize is reached and the
+// whole cache is purged when the configuration changes.
+//
+// Every purge starts a new generation. An answer resolved while a purge
+// happened is built from the old configuration and is not cached, so Set
+// takes the generation read before resolving.
 type DNSCache struct {
-	cache   map[string]*CacheEntry
-	mu      sync.RWMutex
-	maxSize int
+	lru *lruCache[cacheKey, *CacheEntry]
+
+	mu         sync.RWMutex // held for writing while purging
+	generation uint64
+}
+
+type cacheKey struct {
+	qname    string
+	qtype    uint16
+	location string // "" for answers that do not depend on the client
 }
 
 type CacheEntry struct {
-	Value     string
-	ExpiresAt time.Time
+	packed []byte // compressed wire format with the question at offset 12
+	rcode  int
+	geo    bool // marker: answer depends on client location, look up per location
 }
 
 func NewDNSCache(maxSize int) *DNSCache {
-	cache := &DNSCache{
-		cache:   make(map[string]*CacheEntry),
-		maxSize: maxSize,
+	return &DNSCache{
+		lru: newLRUCache[cacheKey, *CacheEntry](maxSize),
 	}
+}
 
-	go cache.cleanupLoop()
-
-	return cache
+func (c *DNSCache) Get(qname string, qtype uint16, location string) (*CacheEntry, bool) {
+	return c.lru.Get(cacheKey{qname: qname, qtype: qtype, location: location})
 }
 
-func (c *DNSCache) Get(key string) (string, bool) {
+// Generation returns the current generation, to be passed to Set and
+// SetGeo for an answer resolved afterwards.
+func (c *DNSCache) Generation() uint64 {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	return c.generation
+}
 
-	entry, ok := c.cache[key]
-	if !ok {
-		return "", false
+// Set packs msg and caches it for the lowest TTL among its answers, unless
+// the cache was purged since generation.
+func (c *DNSCache) Set(qname string, qtype uint16, location string, msg *dns.Msg, generation uint64) {
+	msg.Compress = true
+	packed, err := msg.Pack()
+	if err != nil {
+		return
 	}
 
-	if time.Now().After(entry.ExpiresAt) {
-		return "", false
-	}
+	c.set(cacheKey{qname: qname, qtype: qtype, location: location},
+		&CacheEntry{packed: packed, rcode: msg.Rcode}, cacheTTL(msg), generation)
+}
 
-	return entry.Value, true
+// SetGeo records that (qname, qtype) is answered per client location,
+// unless the cache was purged since generation.
+func (c *DNSCache) SetGeo(qname string, qtype uint16, generation uint64) {
+	c.set(cacheKey{qname: qname, qtype: qtype}, &CacheEntry{geo: true}, maxCacheTTL, generation)
 }
 
-func (c *DNSCache) Set(key string, value string, ttl uint32) {
+func (c *DNSCache) set(key cacheKey, entry *CacheEntry, ttl time.Duration, generation uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if generation == c.generation {
+		c.lru.Set(key, entry, ttl)
+	}
+}
+
+// Purge drops every cached answer and starts a new generation.
+func (c *DNSCache) Purge() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Purge()
+}
 
-	if len(c.cache) >= c.maxSize {
-		return
-	}
-
-	c.cache[key] = &CacheEntry{
-		Value:     value,
-		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
-	}
+func (c *DNSCache) Len() int {
+	return c.lru.Len()
 }
 
-func (c *DNSCache) cleanupLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// responseFor returns a copy of the cached response rewritten for request r:
+// the message ID and RD flag are taken from the request and the question name
+// is re-written with the request's exact casing (answers point to it through
+// name compression).
+func (e *CacheEntry) responseFor(r *dns.Msg) ([]byte, error) {
+	packed := make([]byte, len(e.packed))
+	copy(packed, e.packed)
+
+	packed[0] = byte(r.Id >> 8)
+	packed[1] = byte(r.Id)
+	if r.RecursionDesired {
+		packed[2] |= 0x01
+	} else {
+		packed[2] &^= 0x01
+	}
 
-	for range ticker.C {
-		c.cleanup()
+	if _, err := dns.PackDomainName(r.Question[0].Name, packed, 12, nil, false); err != nil {
+		return nil, err
 	}
+
+	return packed, nil
 }
 
-func (c *DNSCache) cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func cacheTTL(msg *dns.Msg) time.Duration {
+	if len(msg.Answer) == 0 {
+		return negativeCacheTTL
+	}
 
-	now := time.Now()
-	for key, entry := range c.cache {
-		if now.After(entry.ExpiresAt) {
-			delete(c.cache, key)
+	ttl := maxCacheTTL
+	for _, rr := range msg.Answer {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
 		}
 	}
+	return ttl
 }
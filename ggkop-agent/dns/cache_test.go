@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSCache_ResponseForRewritesIDAndCase(t *testing.T) {
+	cache := NewDNSCache(10)
+
+	first := new(dns.Msg)
+	first.SetQuestion("Example.COM.", dns.TypeA)
+	first.Id = 1
+
+	reply := new(dns.Msg)
+	reply.SetReply(first)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "Example.COM.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	cache.Set("example.com", dns.TypeA, "", reply, cache.Generation())
+
+	entry, ok := cache.Get("example.com", dns.TypeA, "")
+	if !ok {
+		t.Fatal("expected cached entry")
+	}
+
+	second := new(dns.Msg)
+	second.SetQuestion("eXAMPLE.com.", dns.TypeA)
+	second.Id = 4242
+	second.RecursionDesired = false
+
+	packed, err := entry.responseFor(second)
+	if err != nil {
+		t.Fatalf("responseFor() error: %v", err)
+	}
+
+	got := new(dns.Msg)
+	if err := got.Unpack(packed); err != nil {
+		t.Fatalf("Unpack() error: %v", err)
+	}
+
+	if got.Id != 4242 {
+		t.Errorf("Id = %d, want 4242", got.Id)
+	}
+	if got.RecursionDesired {
+		t.Error("RecursionDesired = true, want false")
+	}
+	if got.Question[0].Name != "eXAMPLE.com." {
+		t.Errorf("Question name = %s, want eXAMPLE.com.", got.Question[0].Name)
+	}
+	if len(got.Answer) != 1 || got.Answer[0].Header().Name != "eXAMPLE.com." {
+		t.Errorf("Answer = %v, want one record owned by eXAMPLE.com.", got.Answer)
+	}
+}
+
+func TestDNSCache_GeoMarkerAndPurge(t *testing.T) {
+	cache := NewDNSCache(10)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	cache.SetGeo("example.com", dns.TypeA, cache.Generation())
+	cache.Set("example.com", dns.TypeA, "de", msg, cache.Generation())
+
+	if entry, ok := cache.Get("example.com", dns.TypeA, ""); !ok || !entry.geo {
+		t.Error("expected geo marker for example.com A")
+	}
+	if _, ok := cache.Get("example.com", dns.TypeA, "us"); ok {
+		t.Error("expected miss for a different location")
+	}
+
+	cache.Purge()
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %d after Purge, want 0", cache.Len())
+	}
+}
+
+func TestDNSCache_StaleGenerationNotCached(t *testing.T) {
+	cache := NewDNSCache(10)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	// Resolved against the old configuration, stored after the purge
+	generation := cache.Generation()
+	cache.Purge()
+	cache.SetGeo("example.com", dns.TypeA, generation)
+	cache.Set("example.com", dns.TypeA, "", msg, generation)
+
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %d, want answers from before the purge dropped", cache.Len())
+	}
+
+	cache.Set("example.com", dns.TypeA, "", msg, cache.Generation())
+	if _, ok := cache.Get("example.com", dns.TypeA, ""); !ok {
+		t.Error("expected an answer of the current generation to be cached")
+	}
+}
@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// errDoHTsig is the TSIG status of every DoH request: signatures are not
+// verified over HTTPS, so signed requests must never count as authenticated.
+var errDoHTsig = errors.New("TSIG is not verified over DNS-over-HTTPS")
+
+// tlsConfig picks the per-domain certificate from the Core configuration for
+// DoT clients. Nameserver hostnames such as ns1.example.com need a
+// certificate covering them, e.g. *.example.com. Clients without SNI get the
+// certificate of fallbackDomain; other unknown names get the default
+// certificate, or the one of fallbackDomain when there is none.
+func (s *DNSServer) tlsConfig(fallbackDomain string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			candidates := []string{hello.ServerName, fallbackDomain}
+
+			var lastErr error = errors.New("no certificate available")
+			for _, candidate := range candidates {
+				if candidate == "" {
+					continue
+				}
+				named := *hello
+				named.ServerName = candidate
+				cert, err := s.configMgr.GetCertificate(&named)
+				if err == nil {
+					return cert, nil
+				}
+				lastErr = err
+			}
+			log.Printf("[DNS] No TLS certificate for %q: %v", hello.ServerName, lastErr)
+			return nil, lastErr
+		},
+	}
+}
+
+// ServeHTTP answers DNS-over-HTTPS requests (RFC 8484) with the same handler
+// as plain DNS. Responses are never truncated since HTTP carries any size.
+func (s *DNSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if wire, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1)); err != nil {
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		if len(wire) > dns.MaxMsgSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(wire); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remote: httpRemoteAddr(r)}
+	if len(query.Question) == 1 && (query.Question[0].Qtype == dns.TypeAXFR || query.Question[0].Qtype == dns.TypeIXFR) {
+		// Zone transfers need a stream of messages
+		refused := new(dns.Msg)
+		refused.SetRcode(query, dns.RcodeRefused)
+		rw.WriteMsg(refused)
+	} else {
+		s.handleDNSRequest(rw, query)
+	}
+
+	if rw.response == nil {
+		http.Error(w, "no response", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := responseMaxAge(rw.response); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+	}
+	if _, err := w.Write(rw.response); err != nil {
+		log.Printf("[DNS] Error writing DoH response: %v", err)
+	}
+}
+
+// responseMaxAge returns the smallest TTL in the answer, used as the HTTP
+// freshness lifetime (RFC 8484 section 5.1).
+func responseMaxAge(wire []byte) (uint32, bool) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(wire); err != nil || len(msg.Answer) == 0 {
+		return 0, false
+	}
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl, true
+}
+
+// httpRemoteAddr reports the HTTP client as a TCP peer, so DoH queries get
+// TCP treatment (no truncation or response rate limiting).
+func httpRemoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNum}
+}
+
+// dohResponseWriter captures the single response the DNS handler writes.
+type dohResponseWriter struct {
+	remote   net.Addr
+	response []byte
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.response = packed
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.response = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return errDoHTsig }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+	"github.com/miekg/dns"
+)
+
+func TestServeHTTP_DoH(t *testing.T) {
+	server := &DNSServer{
+		configMgr: config.NewConfigManager("", "", ""),
+		cache:     NewDNSCache(10),
+		zones:     NewZoneStore(),
+		stats:     &DNSStats{},
+		udpSize:   DefaultUDPSize,
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("unknown.example.", dns.TypeA)
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		request    *http.Request
+		wantStatus int
+	}{
+		{"GET", httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(wire), nil), http.StatusOK},
+		{"POST", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(wire))
+			r.Header.Set("Content-Type", dohMediaType)
+			return r
+		}(), http.StatusOK},
+		{"POST wrong type", httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(wire)), http.StatusUnsupportedMediaType},
+		{"GET without dns", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, tt.request)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != dohMediaType {
+				t.Errorf("Content-Type = %s, want %s", ct, dohMediaType)
+			}
+			body, _ := io.ReadAll(rec.Body)
+			resp := new(dns.Msg)
+			if err := resp.Unpack(body); err != nil {
+				t.Fatalf("Unpack() error: %v", err)
+			}
+			if resp.Rcode != dns.RcodeNameError || resp.Question[0].Name != "unknown.example." {
+				t.Errorf("response rcode = %s, question = %v", dns.RcodeToString[resp.Rcode], resp.Question)
+			}
+		})
+	}
+}
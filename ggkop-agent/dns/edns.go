@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultUDPSize is the EDNS buffer size we advertise and the largest UDP
+	// response we send (DNS flag day 2020: avoids IP fragmentation).
+	DefaultUDPSize = 1232
+	// Without EDNS a UDP response may not exceed 512 bytes (RFC 1035).
+	minUDPSize = dns.MinMsgSize
+)
+
+// validateRequest returns the rcode to reject r with, or RcodeSuccess. The
+// miekg/dns accept function has already answered messages whose header or
+// wire format is broken; this catches what only shows after unpacking.
+func validateRequest(r *dns.Msg) int {
+	if r.Opcode != dns.OpcodeQuery && r.Opcode != dns.OpcodeNotify {
+		return dns.RcodeNotImplemented
+	}
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+
+	optCount := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			optCount++
+		}
+	}
+	if optCount > 1 {
+		return dns.RcodeFormatError
+	}
+
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		return dns.RcodeBadVers
+	}
+
+	return dns.RcodeSuccess
+}
+
+// replyOPT builds the OPT record for a response, or returns nil when the
+// query did not use EDNS. The DO bit is echoed and NSID is only included
+// when the client asked for it.
+func (s *DNSServer) replyOPT(query *dns.OPT) *dns.OPT {
+	if query == nil {
+		return nil
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(s.udpSize)
+	if query.Do() {
+		opt.SetDo()
+	}
+
+	if s.nsid != "" {
+		for _, option := range query.Option {
+			if option.Option() == dns.EDNS0NSID {
+				opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+					Code: dns.EDNS0NSID,
+					Nsid: hex.EncodeToString([]byte(s.nsid)),
+				})
+				break
+			}
+		}
+	}
+
+	return opt
+}
+
+// maxResponseSize is the largest response the client can take over its
+// transport.
+func (s *DNSServer) maxResponseSize(query *dns.OPT, udp bool) int {
+	if !udp {
+		return dns.MaxMsgSize
+	}
+	if query == nil {
+		return minUDPSize
+	}
+
+	size := int(query.UDPSize())
+	if size > int(s.udpSize) {
+		size = int(s.udpSize)
+	}
+	if size < minUDPSize {
+		size = minUDPSize
+	}
+	return size
+}
+
+// finishResponse adds the EDNS reply and truncates msg (setting TC) if it
+// does not fit the client's UDP buffer.
+func (s *DNSServer) finishResponse(r, msg *dns.Msg, udp bool) {
+	query := r.IsEdns0()
+	if opt := s.replyOPT(query); opt != nil {
+		msg.Extra = append(msg.Extra, opt)
+	}
+
+	msg.Compress = true
+	limit := s.maxResponseSize(query, udp)
+	if msg.Len() > limit {
+		msg.Truncate(limit)
+		atomic.AddUint64(&s.stats.Truncated, 1)
+	}
+}
+
+// finishPacked is finishResponse for a cached wire-format response. The OPT
+// record is appended in place; only responses too large for the client are
+// unpacked to be truncated.
+func (s *DNSServer) finishPacked(r *dns.Msg, packed []byte, udp bool) ([]byte, error) {
+	query := r.IsEdns0()
+	if opt := s.replyOPT(query); opt != nil {
+		out := make([]byte, len(packed)+dns.Len(opt))
+		copy(out, packed)
+		off, err := dns.PackRR(opt, out, len(packed), nil, false)
+		if err != nil {
+			return nil, err
+		}
+		packed = out[:off]
+		binary.BigEndian.PutUint16(packed[10:], binary.BigEndian.Uint16(packed[10:])+1)
+	}
+
+	limit := s.maxResponseSize(query, udp)
+	if len(packed) <= limit {
+		return packed, nil
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packed); err != nil {
+		return nil, err
+	}
+	msg.Truncate(limit)
+	atomic.AddUint64(&s.stats.Truncated, 1)
+	return msg.Pack()
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateRequest(t *testing.T) {
+	query := func(modify func(m *dns.Msg)) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		modify(m)
+		return m
+	}
+
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		want int
+	}{
+		{"plain query", query(func(m *dns.Msg) {}), dns.RcodeSuccess},
+		{"edns0", query(func(m *dns.Msg) { m.SetEdns0(4096, true) }), dns.RcodeSuccess},
+		{"no question", query(func(m *dns.Msg) { m.Question = nil }), dns.RcodeFormatError},
+		{"two questions", query(func(m *dns.Msg) {
+			m.Question = append(m.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		}), dns.RcodeFormatError},
+		{"two OPT records", query(func(m *dns.Msg) {
+			m.SetEdns0(4096, false)
+			m.Extra = append(m.Extra, m.Extra[0])
+		}), dns.RcodeFormatError},
+		{"edns version 1", query(func(m *dns.Msg) {
+			m.SetEdns0(4096, false)
+			m.IsEdns0().SetVersion(1)
+		}), dns.RcodeBadVers},
+		{"update opcode", query(func(m *dns.Msg) { m.Opcode = dns.OpcodeUpdate }), dns.RcodeNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateRequest(tt.msg); got != tt.want {
+				t.Errorf("validateRequest() = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[tt.want])
+			}
+		})
+	}
+}
+
+func TestFinishResponse_EDNSAndTruncation(t *testing.T) {
+	s := &DNSServer{stats: &DNSStats{}, udpSize: DefaultUDPSize, nsid: "agent-1"}
+
+	bigAnswer := func(r *dns.Msg) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for i := 0; i < 20; i++ {
+			msg.Answer = append(msg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{fmt.Sprintf("v=record-%02d-padding-padding-padding", i)},
+			})
+		}
+		return msg
+	}
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeTXT)
+	msg := bigAnswer(plain)
+	s.finishResponse(plain, msg, true)
+	if !msg.Truncated || msg.Len() > minUDPSize || msg.IsEdns0() != nil {
+		t.Errorf("no EDNS: truncated = %v, len = %d, opt = %v; want TC, <= 512 bytes, no OPT", msg.Truncated, msg.Len(), msg.IsEdns0())
+	}
+
+	edns := new(dns.Msg)
+	edns.SetQuestion("example.com.", dns.TypeTXT)
+	edns.SetEdns0(4096, true)
+	edns.IsEdns0().Option = append(edns.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	msg = bigAnswer(edns)
+	s.finishResponse(edns, msg, true)
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected OPT in response")
+	}
+	if opt.UDPSize() != DefaultUDPSize || !opt.Do() {
+		t.Errorf("OPT size = %d, do = %v; want %d, true", opt.UDPSize(), opt.Do(), DefaultUDPSize)
+	}
+	if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0NSID {
+		t.Errorf("OPT options = %v, want NSID", opt.Option)
+	}
+	if msg.Truncated {
+		t.Errorf("EDNS response of %d bytes truncated, want it to fit %d", msg.Len(), DefaultUDPSize)
+	}
+
+	// Cached wire responses get the same treatment
+	cached := bigAnswer(plain)
+	cached.Compress = true
+	packed, _ := cached.Pack()
+	out, err := s.finishPacked(edns, packed, true)
+	if err != nil {
+		t.Fatalf("finishPacked() error: %v", err)
+	}
+	got := new(dns.Msg)
+	if err := got.Unpack(out); err != nil {
+		t.Fatalf("Unpack() error: %v", err)
+	}
+	if got.IsEdns0() == nil || len(got.Answer) != 20 {
+		t.Errorf("finishPacked: opt = %v, answers = %d; want OPT and 20 answers", got.IsEdns0(), len(got.Answer))
+	}
+}
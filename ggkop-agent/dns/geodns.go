@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"log"
+	"sort"
+
+	"github.com/ggkop/agent/config"
+)
+
+// countryFallbacks lists nearby countries to try when a client's own country
+// has no GeoDNS entry.
+var countryFallbacks = map[string][]string{
+	"us": {"ca", "mx", "gb", "de"},
+	"ca": {"us", "mx", "gb", "de"},
+	"mx": {"us", "ca", "br", "cl"},
+	"br": {"ar", "cl", "us", "mx"},
+	"ar": {"br", "cl", "mx", "us"},
+	"cl": {"ar", "br", "mx", "us"},
+	"co": {"br", "ar", "mx", "cl"},
+	"gb": {"de", "fr", "nl", "us"},
+	"de": {"nl", "fr", "gb", "pl"},
+	"fr": {"de", "gb", "es", "it"},
+	"it": {"fr", "de", "es", "tr"},
+	"es": {"fr", "it", "br", "mx"},
+	"nl": {"de", "gb", "fr", "pl"},
+	"pl": {"de", "ua", "ru", "nl"},
+	"ua": {"pl", "ru", "tr", "de"},
+	"ru": {"ua", "pl", "kz", "cn"},
+	"cn": {"jp", "kr", "sg", "in"},
+	"jp": {"kr", "cn", "sg", "au"},
+	"kr": {"jp", "cn", "sg", "au"},
+	"in": {"sg", "th", "id", "ae"},
+	"id": {"sg", "th", "au", "in"},
+	"th": {"sg", "id", "in", "cn"},
+	"sg": {"id", "th", "in", "au"},
+	"au": {"nz", "sg", "id", "jp"},
+	"nz": {"au", "sg", "id", "jp"},
+	"za": {"eg", "ng", "ae", "gb"},
+	"eg": {"ae", "tr", "za", "ng"},
+	"ng": {"za", "eg", "br", "fr"},
+	"ae": {"ir", "tr", "in", "eg"},
+	"tr": {"ae", "ir", "eg", "it"},
+	"ir": {"ae", "tr", "kz", "in"},
+	"kz": {"ru", "cn", "ir", "tr"},
+}
+
+// continentFallbacks is the representative country for each continent, used
+// when neither the client's country nor its continent has an entry.
+var continentFallbacks = map[string]string{
+	"europe":        "de",
+	"north-america": "us",
+	"south-america": "br",
+	"asia":          "sg",
+	"oceania":       "au",
+	"africa":        "za",
+}
+
+// geoDNSCandidates returns the GeoDNS map keys to try for a client, most
+// specific first:
+//
+//  1. Custom     (office-msk) - only set by GeoIP overrides
+//  2. ASN        (as13335)    - operator overrides for specific networks
+//  3. Region     (us-ca)
+//  4. Country    (us)
+//  5. Continent  (north-america)
+//  6. Nearby countries, then the continent's representative country
+//
+// "default" and any-entry fallbacks are handled by findBestAgentIP.
+func geoDNSCandidates(loc ClientLocation) []string {
+	candidates := make([]string, 0, 8)
+
+	if loc.Custom != "" {
+		candidates = append(candidates, loc.Custom)
+	}
+	if loc.ASN != 0 {
+		candidates = append(candidates, config.ASNKey(loc.ASN))
+	}
+	if loc.Region != "" {
+		candidates = append(candidates, loc.Region)
+	}
+	if loc.Country != "" {
+		candidates = append(candidates, loc.Country)
+	}
+	if loc.Continent != "" {
+		candidates = append(candidates, loc.Continent)
+	}
+	candidates = append(candidates, countryFallbacks[loc.Country]...)
+	if country, ok := continentFallbacks[loc.Continent]; ok {
+		candidates = append(candidates, country)
+	}
+
+	return candidates
+}
+
+func findBestAgentIP(geoDNSMap map[string]string, loc ClientLocation) string {
+	for _, key := range geoDNSCandidates(loc) {
+		if ip, ok := geoDNSMap[key]; ok {
+			return ip
+		}
+	}
+
+	// Use default if available
+	if ip, ok := geoDNSMap["default"]; ok {
+		return ip
+	}
+
+	// Return any available IP as last resort (sorted for stable answers)
+	if len(geoDNSMap) > 0 {
+		keys := make([]string, 0, len(geoDNSMap))
+		for key := range geoDNSMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		location := keys[0]
+		log.Printf("[GeoDNS] No default available, using any available location '%s' -> %s", location, geoDNSMap[location])
+		return geoDNSMap[location]
+	}
+
+	log.Printf("[GeoDNS] No agent IPs available in GeoDNS map")
+	return ""
+}
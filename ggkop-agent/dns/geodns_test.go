@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestFindBestAgentIP_Precedence(t *testing.T) {
+	geoDNSMap := map[string]string{
+		"as7922":        "10.0.0.1",
+		"us-ca":         "10.0.0.2",
+		"us":            "10.0.0.3",
+		"north-america": "10.0.0.4",
+		"europe":        "10.0.0.5",
+		"default":       "10.0.0.9",
+	}
+
+	tests := []struct {
+		name   string
+		loc    ClientLocation
+		wantIP string
+	}{
+		{
+			name:   "ASN beats region",
+			loc:    ClientLocation{Country: "us", Region: "us-ca", Continent: "north-america", ASN: 7922},
+			wantIP: "10.0.0.1",
+		},
+		{
+			name:   "Region beats country",
+			loc:    ClientLocation{Country: "us", Region: "us-ca", Continent: "north-america", ASN: 15169},
+			wantIP: "10.0.0.2",
+		},
+		{
+			name:   "Country when region unknown",
+			loc:    ClientLocation{Country: "us", Region: "us-ny", Continent: "north-america"},
+			wantIP: "10.0.0.3",
+		},
+		{
+			name:   "Continent when country unknown",
+			loc:    ClientLocation{Country: "pt", Continent: "europe"},
+			wantIP: "10.0.0.5",
+		},
+		{
+			name:   "Default for unknown client",
+			loc:    ClientLocation{},
+			wantIP: "10.0.0.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findBestAgentIP(geoDNSMap, tt.loc); got != tt.wantIP {
+				t.Errorf("findBestAgentIP() = %s, want %s", got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestFindBestAgentIP_CountryFallback(t *testing.T) {
+	geoDNSMap := map[string]string{
+		"pl":      "10.0.0.1",
+		"default": "10.0.0.9",
+	}
+
+	loc := ClientLocation{Country: "ua", Continent: "europe"}
+	if got := findBestAgentIP(geoDNSMap, loc); got != "10.0.0.1" {
+		t.Errorf("findBestAgentIP() = %s, want 10.0.0.1", got)
+	}
+}
+
+func TestNormalizeGeoDNSKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		recordName   string
+		locationType string
+		wantKey      string
+		wantOK       bool
+	}{
+		{"Listed country", "US", "country", "us", true},
+		{"Listed region", "us-CA", "region", "us-ca", true},
+		{"Listed ASN", "AS13335", "asn", "as13335", true},
+		{"Listed continent name", "europe", "continent", "europe", true},
+		{"Listed continent code", "eu", "continent", "europe", true},
+		{"Custom location", "moscow-dc", "custom", "moscow-dc", true},
+		{"Country prefix", "country:de", "", "de", true},
+		{"Region prefix", "region:us-ca", "", "us-ca", true},
+		{"ASN prefix", "asn:13335", "", "as13335", true},
+		{"Continent prefix", "continent:as", "", "asia", true},
+		{"Invalid prefixed key", "continent:atlantis", "", "", false},
+		{"Listed type mismatch", "www", "country", "", false},
+		{"Unlisted two-letter label", "db", "", "", false},
+		{"Unlisted region look-alike", "my-app", "", "", false},
+		{"Unlisted continent name", "europe", "", "", false},
+		{"Unlisted ASN look-alike", "as13335", "", "", false},
+		{"Subdomain", "www", "", "", false},
+		{"Apex", "@", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := config.NormalizeGeoDNSKey(tt.recordName, tt.locationType)
+			if key != tt.wantKey || ok != tt.wantOK {
+				t.Errorf("NormalizeGeoDNSKey(%q, %q) = (%q, %v), want (%q, %v)",
+					tt.recordName, tt.locationType, key, ok, tt.wantKey, tt.wantOK)
+			}
+		})
+	}
+}
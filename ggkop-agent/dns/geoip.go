@@ -3,89 +3,244 @@ package dns
 import (
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ggkop/agent/config"
 	"github.com/oschwald/geoip2-golang"
 )
 
+// GeoIPConfig controls where the MaxMind databases are loaded from and how
+// lookups are cached.
+type GeoIPConfig struct {
+	CityDBPath     string
+	ASNDBPath      string
+	CacheSize      int
+	CacheTTL       time.Duration
+	ReloadInterval time.Duration // how often database files are checked for changes
+	OverridesFile  string        // optional "CIDR location" override list
+}
+
+func DefaultGeoIPConfig() GeoIPConfig {
+	return GeoIPConfig{
+		CityDBPath:     "GeoLite2-City.mmdb",
+		ASNDBPath:      "GeoLite2-ASN.mmdb",
+		CacheSize:      100000,
+		CacheTTL:       time.Hour,
+		ReloadInterval: time.Minute,
+	}
+}
+
+// readerCloseDelay is how long a replaced database stays open so lookups that
+// already hold it can finish.
+const readerCloseDelay = 30 * time.Second
+
 type GeoIPService struct {
-	db    *geoip2.Reader
-	cache map[string]string
-	mu    sync.RWMutex
+	cfg   GeoIPConfig
+	city  geoDatabase
+	asn   geoDatabase
+	cache *lruCache[string, ClientLocation]
+
+	stopOnce sync.Once
+	stopChan chan struct{}
 }
 
-func NewGeoIPService(dbPath string) (*GeoIPService, error) {
-	db, err := geoip2.Open(dbPath)
-	if err != nil {
-		return nil, err
+// geoDatabase is a MaxMind reader that can be swapped while in use.
+type geoDatabase struct {
+	path    string
+	name    string
+	reader  atomic.Pointer[geoip2.Reader]
+	modTime time.Time
+	size    int64
+}
+
+// ClientLocation is everything GeoDNS knows about where a client is.
+// Empty fields mean the database had no answer for that level.
+type ClientLocation struct {
+	Custom    string // custom location from a GeoIP override ("office-msk")
+	Country   string // ISO 3166-1 alpha-2, lowercase ("us")
+	Region    string // ISO 3166-2 subdivision, lowercase ("us-ca")
+	Continent string // canonical continent key ("north-america")
+	ASN       uint
+}
+
+// NewGeoIPService loads the City and ASN databases and starts watching both
+// files for replacement. A database missing at startup answers no lookups
+// until its file appears.
+func NewGeoIPService(cfg GeoIPConfig) *GeoIPService {
+	g := &GeoIPService{
+		cfg:      cfg,
+		city:     geoDatabase{path: cfg.CityDBPath, name: "City"},
+		asn:      geoDatabase{path: cfg.ASNDBPath, name: "ASN"},
+		cache:    newLRUCache[string, ClientLocation](cfg.CacheSize),
+		stopChan: make(chan struct{}),
+	}
+
+	if g.city.path != "" {
+		if _, err := g.city.reload(); err != nil {
+			log.Printf("[GeoIP] City database not available: %v", err)
+			log.Println("[GeoIP] GeoDNS will use fallback logic until it is loaded")
+		}
+	}
+
+	if g.asn.path != "" {
+		if _, err := g.asn.reload(); err != nil {
+			log.Printf("[GeoIP] ASN database not available: %v", err)
+			log.Println("[GeoIP] ASN-keyed GeoDNS entries will be ignored until it is loaded")
+		}
 	}
 
-	return &GeoIPService{
-		db:    db,
-		cache: make(map[string]string),
-	}, nil
+	if cfg.ReloadInterval > 0 {
+		go g.watchLoop()
+	}
+
+	return g
 }
 
-func (g *GeoIPService) GetLocation(ip string) string {
-	g.mu.RLock()
-	if loc, ok := g.cache[ip]; ok {
-		g.mu.RUnlock()
+func (g *GeoIPService) GetLocation(ip string) ClientLocation {
+	if loc, ok := g.cache.Get(ip); ok {
 		return loc
 	}
-	g.mu.RUnlock()
 
 	location := g.lookupLocation(ip)
-
-	g.mu.Lock()
-	g.cache[ip] = location
-	g.mu.Unlock()
+	g.cache.Set(ip, location, g.cfg.CacheTTL)
 
 	return location
 }
 
-func (g *GeoIPService) lookupLocation(ip string) string {
+func (g *GeoIPService) lookupLocation(ip string) ClientLocation {
+	var location ClientLocation
+
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
-		return "default"
+		return location
+	}
+
+	if db := g.city.reader.Load(); db != nil {
+		record, err := db.City(parsedIP)
+		if err != nil {
+			log.Printf("[GeoIP] City lookup failed for %s: %v", ip, err)
+		} else {
+			location.Country = strings.ToLower(record.Country.IsoCode)
+			location.Continent = config.ContinentKey(record.Continent.Code)
+			if location.Country != "" && len(record.Subdivisions) > 0 && record.Subdivisions[0].IsoCode != "" {
+				location.Region = location.Country + "-" + strings.ToLower(record.Subdivisions[0].IsoCode)
+			}
+		}
+	}
+
+	if db := g.asn.reader.Load(); db != nil {
+		if asn, err := db.ASN(parsedIP); err == nil {
+			location.ASN = asn.AutonomousSystemNumber
+		}
 	}
 
-	record, err := g.db.City(parsedIP)
+	if location.IsZero() {
+		log.Printf("[GeoIP] Could not determine location for IP %s", ip)
+	}
+
+	return location
+}
+
+// watchLoop polls the database files and swaps in new readers when a file is
+// replaced on disk. Queries keep using the old reader until the swap.
+func (g *GeoIPService) watchLoop() {
+	ticker := time.NewTicker(g.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded := false
+			for _, db := range []*geoDatabase{&g.city, &g.asn} {
+				if db.path == "" {
+					continue
+				}
+				changed, err := db.reload()
+				if err != nil {
+					log.Printf("[GeoIP] Failed to reload %s database %s: %v", db.name, db.path, err)
+					continue
+				}
+				reloaded = reloaded || changed
+			}
+			if reloaded {
+				g.cache.Purge()
+			}
+		case <-g.stopChan:
+			return
+		}
+	}
+}
+
+// reload opens the database if the file changed since the last load and
+// atomically replaces the active reader. It reports whether a swap happened.
+func (d *geoDatabase) reload() (bool, error) {
+	info, err := os.Stat(d.path)
 	if err != nil {
-		return "default"
+		return false, err
 	}
 
-	countryCode := strings.ToLower(record.Country.IsoCode)
-	
-	// Return country code directly - routing is handled by GeoDNS map from API
-	if countryCode != "" {
-		return countryCode
+	if d.reader.Load() != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return false, nil
 	}
 
-	// Fallback to continent for unknown countries
-	continent := strings.ToLower(record.Continent.Code)
-	
-	continentMap := map[string]string{
-		"eu": "de", // Europe -> Germany
-		"na": "us", // North America -> USA
-		"sa": "br", // South America -> Brazil
-		"as": "sg", // Asia -> Singapore
-		"oc": "au", // Oceania -> Australia
-		"af": "za", // Africa -> South Africa
+	reader, err := geoip2.Open(d.path)
+	if err != nil {
+		return false, err
 	}
 
-	if location, ok := continentMap[continent]; ok {
-		log.Printf("[GeoIP] Country %s (continent: %s) not in map, using fallback: %s", countryCode, continent, location)
-		return location
+	old := d.reader.Swap(reader)
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+
+	meta := reader.Metadata()
+	log.Printf("[GeoIP] Loaded %s database %s (%s, built %s)", d.name, d.path, meta.DatabaseType,
+		time.Unix(int64(meta.BuildEpoch), 0).UTC().Format(time.RFC3339))
+
+	if old != nil {
+		time.AfterFunc(readerCloseDelay, func() {
+			old.Close()
+		})
 	}
 
-	log.Printf("[GeoIP] Could not determine location for IP %s (country: %s, continent: %s)", ip, countryCode, continent)
-	return "default"
+	return true, nil
 }
 
-func (g *GeoIPService) Close() error {
-	if g.db != nil {
-		return g.db.Close()
+func (d *geoDatabase) close() error {
+	if reader := d.reader.Swap(nil); reader != nil {
+		return reader.Close()
 	}
 	return nil
 }
+
+func (g *GeoIPService) Close() error {
+	g.stopOnce.Do(func() {
+		close(g.stopChan)
+	})
+	g.asn.close()
+	return g.city.close()
+}
+
+func (l ClientLocation) IsZero() bool {
+	return l == ClientLocation{}
+}
+
+func (l ClientLocation) String() string {
+	if l.IsZero() {
+		return "default"
+	}
+
+	parts := make([]string, 0, 5)
+	for _, part := range []string{l.Custom, l.Region, l.Country, l.Continent} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if l.ASN != 0 {
+		parts = append(parts, config.ASNKey(l.ASN))
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,21 @@
+package dns
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoIPService_MissingDatabases(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultGeoIPConfig()
+	cfg.CityDBPath = filepath.Join(dir, "GeoLite2-City.mmdb")
+	cfg.ASNDBPath = filepath.Join(dir, "GeoLite2-ASN.mmdb")
+
+	// Still started, so the watch loop can load the files once they appear
+	geoIP := NewGeoIPService(cfg)
+	defer geoIP.Close()
+
+	if loc := geoIP.GetLocation("192.0.2.1"); !loc.IsZero() {
+		t.Errorf("GetLocation() = %v, want no location without databases", loc)
+	}
+}
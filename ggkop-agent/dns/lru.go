@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded cache with per-entry expiry. The least recently
+// used entry is evicted when the cache is full; expired entries are dropped
+// lazily on access.
+type lruCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	maxSize int
+	ll      *list.List
+	items   map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+func newLRUCache[K comparable, V any](maxSize int) *lruCache[K, V] {
+	if maxSize <= 0 {
+		maxSize = 1
+	}
+	return &lruCache[K, V]{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[K]*list.Element, maxSize),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	elem, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+
+	entry := elem.Value.(*lruEntry[K, V])
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return zero, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache[K, V]) Set(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	elem := c.ll.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	c.items[key] = elem
+
+	for c.ll.Len() > c.maxSize {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// GetOrAdd returns the live entry for key (sliding its expiry forward), or
+// stores and returns the value produced by create. The check and insert
+// happen under one lock.
+func (c *lruCache[K, V]) GetOrAdd(key K, create func() V, ttl time.Duration) V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry[K, V])
+		if time.Now().Before(entry.expiresAt) {
+			entry.expiresAt = time.Now().Add(ttl)
+			c.ll.MoveToFront(elem)
+			return entry.value
+		}
+		c.removeElement(elem)
+	}
+
+	value := create()
+	elem := c.ll.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	c.items[key] = elem
+
+	for c.ll.Len() > c.maxSize {
+		c.removeElement(c.ll.Back())
+	}
+	return value
+}
+
+// Purge drops every entry.
+func (c *lruCache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[K]*list.Element, c.maxSize)
+}
+
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *lruCache[K, V]) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry[K, V]).key)
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache[string, int](2)
+
+	cache.Set("a", 1, time.Minute)
+	cache.Set("b", 2, time.Minute)
+
+	// Touch "a" so "b" becomes the eviction candidate
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	cache.Set("c", 3, time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if v, ok := cache.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %d, %v, want 1, true", v, ok)
+	}
+	if v, ok := cache.Get("c"); !ok || v != 3 {
+		t.Errorf("Get(c) = %d, %v, want 3, true", v, ok)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", cache.Len())
+	}
+}
+
+func TestLRUCache_Expiry(t *testing.T) {
+	cache := newLRUCache[string, int](10)
+
+	cache.Set("a", 1, -time.Second)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("expected expired entry to miss")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %d, want 0 after expired entry is dropped", cache.Len())
+	}
+}
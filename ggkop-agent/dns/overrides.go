@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+// GeoIPOverrides maps CIDR ranges to fixed client locations. It is consulted
+// before the MaxMind lookup so private ranges, office networks and
+// misgeolocated ISPs can be pinned to a location.
+//
+// Entries come from two sources that are merged into one trie: a local file
+// (GEOIP_OVERRIDES_FILE) and the geoIpOverrides list delivered by Core. When
+// both contain the same prefix the local file wins.
+type GeoIPOverrides struct {
+	trie atomic.Pointer[prefixTrie]
+
+	mu            sync.Mutex
+	filePath      string
+	fileModTime   time.Time
+	fileEntries   []config.GeoIPOverride
+	configEntries []config.GeoIPOverride
+}
+
+func NewGeoIPOverrides(filePath string) *GeoIPOverrides {
+	o := &GeoIPOverrides{filePath: filePath}
+	o.trie.Store(newPrefixTrie())
+
+	if filePath != "" {
+		if _, err := o.reloadFile(); err != nil {
+			log.Printf("[GeoIP] Failed to load overrides file %s: %v", filePath, err)
+		}
+	}
+
+	return o
+}
+
+// Lookup returns the override location for ip, if any.
+func (o *GeoIPOverrides) Lookup(ip string) (ClientLocation, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ClientLocation{}, false
+	}
+	return o.trie.Load().Lookup(addr)
+}
+
+// SetConfigEntries replaces the Core-delivered overrides.
+func (o *GeoIPOverrides) SetConfigEntries(entries []config.GeoIPOverride) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if slices.Equal(o.configEntries, entries) {
+		return
+	}
+	o.configEntries = entries
+	o.rebuild()
+}
+
+// WatchFile re-reads the overrides file whenever it changes on disk.
+func (o *GeoIPOverrides) WatchFile(interval time.Duration) {
+	if o.filePath == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := o.reloadFile(); err != nil {
+			log.Printf("[GeoIP] Failed to reload overrides file %s: %v", o.filePath, err)
+		}
+	}
+}
+
+func (o *GeoIPOverrides) reloadFile() (bool, error) {
+	info, err := os.Stat(o.filePath)
+	if err != nil {
+		return false, err
+	}
+
+	o.mu.Lock()
+	unchanged := info.ModTime().Equal(o.fileModTime)
+	o.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	entries, err := readOverridesFile(o.filePath)
+	if err != nil {
+		return false, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.fileEntries = entries
+	o.fileModTime = info.ModTime()
+	o.rebuild()
+
+	return true, nil
+}
+
+// rebuild builds a fresh trie from both sources and swaps it in. Must be
+// called with o.mu held.
+func (o *GeoIPOverrides) rebuild() {
+	trie := newPrefixTrie()
+
+	for _, entries := range [][]config.GeoIPOverride{o.configEntries, o.fileEntries} {
+		for _, entry := range entries {
+			prefix, err := parseOverridePrefix(entry.CIDR)
+			if err != nil {
+				log.Printf("[GeoIP] WARNING: Invalid override CIDR %q: %v - skipping", entry.CIDR, err)
+				continue
+			}
+			loc, ok := parseOverrideLocation(entry.Location)
+			if !ok {
+				log.Printf("[GeoIP] WARNING: Invalid override location %q for %s - skipping", entry.Location, entry.CIDR)
+				continue
+			}
+			trie.Insert(prefix, loc)
+		}
+	}
+
+	o.trie.Store(trie)
+	log.Printf("[GeoIP] Loaded %d override prefixes (%d from file, %d from config)",
+		trie.Len(), len(o.fileEntries), len(o.configEntries))
+}
+
+// readOverridesFile parses a whitespace separated "CIDR location" file.
+// Blank lines and lines starting with # are ignored.
+func readOverridesFile(path string) ([]config.GeoIPOverride, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []config.GeoIPOverride
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"CIDR location\", got %q", lineNum, line)
+		}
+		entries = append(entries, config.GeoIPOverride{CIDR: fields[0], Location: fields[1]})
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseOverridePrefix accepts a CIDR or a bare IP address (treated as a host route).
+func parseOverridePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix, nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseOverrideLocation turns a GeoDNS key into the ClientLocation it stands
+// for. Countries may be given bare ("de"); regions, continents and ASNs need
+// their prefix ("region:us-ca", "continent:europe", "asn:64500"). Any other
+// bare name is a custom location matching GeoDNS entries of the same name.
+func parseOverrideLocation(location string) (ClientLocation, bool) {
+	location = strings.ToLower(strings.TrimSpace(location))
+	if location == "" {
+		return ClientLocation{}, false
+	}
+
+	if !strings.Contains(location, ":") {
+		if country, ok := config.NormalizeGeoDNSKey("country:"+location, ""); ok {
+			return ClientLocation{Country: country}, true
+		}
+		return ClientLocation{Custom: location}, true
+	}
+	key, ok := config.NormalizeGeoDNSKey(location, "")
+	if !ok {
+		return ClientLocation{}, false
+	}
+
+	switch {
+	case config.ContinentKey(key) == key && len(key) > 2:
+		return ClientLocation{Continent: key}, true
+	case strings.Contains(key, "-"):
+		// Before the ASN case: "as-01" is a region of American Samoa
+		return ClientLocation{Country: key[:2], Region: key}, true
+	case strings.HasPrefix(key, "as") && len(key) > 2:
+		asn, err := strconv.ParseUint(key[2:], 10, 32)
+		if err != nil {
+			return ClientLocation{}, false
+		}
+		return ClientLocation{ASN: uint(asn)}, true
+	default:
+		return ClientLocation{Country: key}, true
+	}
+}
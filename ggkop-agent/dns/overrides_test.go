@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestGeoIPOverrides_LongestPrefixMatch(t *testing.T) {
+	overrides := NewGeoIPOverrides("")
+	overrides.SetConfigEntries([]config.GeoIPOverride{
+		{CIDR: "10.0.0.0/8", Location: "de"},
+		{CIDR: "10.1.0.0/16", Location: "office-msk"},
+		{CIDR: "10.1.2.3", Location: "region:us-ca"},
+		{CIDR: "2001:db8::/32", Location: "continent:europe"},
+		{CIDR: "192.0.2.0/24", Location: "asn:64500"},
+		{CIDR: "172.16.0.0/12", Location: "region:as-01"},
+		{CIDR: "198.51.100.0/24", Location: "europe"},
+		{CIDR: "203.0.113.0/24", Location: "us-east"},
+		{CIDR: "100.64.0.0/10", Location: "continent:atlantis"},
+	})
+
+	tests := []struct {
+		name    string
+		ip      string
+		wantLoc ClientLocation
+		wantOK  bool
+	}{
+		{"Broad prefix", "10.200.0.1", ClientLocation{Country: "de"}, true},
+		{"More specific prefix", "10.1.9.9", ClientLocation{Custom: "office-msk"}, true},
+		{"Host route", "10.1.2.3", ClientLocation{Country: "us", Region: "us-ca"}, true},
+		{"IPv6", "2001:db8::1", ClientLocation{Continent: "europe"}, true},
+		{"IPv4-mapped IPv6", "::ffff:10.200.0.1", ClientLocation{Country: "de"}, true},
+		{"ASN", "192.0.2.10", ClientLocation{ASN: 64500}, true},
+		{"Region starting with as", "172.16.0.1", ClientLocation{Country: "as", Region: "as-01"}, true},
+		{"Bare continent name is custom", "198.51.100.1", ClientLocation{Custom: "europe"}, true},
+		{"Region look-alike is custom", "203.0.113.1", ClientLocation{Custom: "us-east"}, true},
+		{"Invalid prefixed location skipped", "100.64.0.1", ClientLocation{}, false},
+		{"No match", "8.8.8.8", ClientLocation{}, false},
+		{"Invalid IP", "not-an-ip", ClientLocation{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, ok := overrides.Lookup(tt.ip)
+			if loc != tt.wantLoc || ok != tt.wantOK {
+				t.Errorf("Lookup(%s) = %+v, %v, want %+v, %v", tt.ip, loc, ok, tt.wantLoc, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGeoIPOverrides_FileWinsOverConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.txt")
+	content := "# office networks\n10.0.0.0/8   fr  # paris\n\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write overrides file: %v", err)
+	}
+
+	overrides := NewGeoIPOverrides(path)
+	overrides.SetConfigEntries([]config.GeoIPOverride{{CIDR: "10.0.0.0/8", Location: "de"}})
+
+	loc, ok := overrides.Lookup("10.0.0.1")
+	if !ok || loc.Country != "fr" {
+		t.Errorf("Lookup() = %+v, %v, want country fr from file", loc, ok)
+	}
+}
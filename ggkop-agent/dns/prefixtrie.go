@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"net/netip"
+)
+
+// prefixTrie is a binary trie keyed on IP prefix bits, giving longest-prefix
+// match lookups in at most 32 (IPv4) or 128 (IPv6) steps. It is built once and
+// then only read, so lookups need no locking.
+type prefixTrie struct {
+	root4 *trieNode
+	root6 *trieNode
+	size  int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	value    *ClientLocation
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{
+		root4: &trieNode{},
+		root6: &trieNode{},
+	}
+}
+
+// Insert stores loc for prefix, replacing any existing value for the exact
+// same prefix.
+func (t *prefixTrie) Insert(prefix netip.Prefix, loc ClientLocation) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+
+	node := t.root6
+	if addr.Is4() {
+		node = t.root4
+	}
+
+	bytes := addr.AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := (bytes[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+
+	if node.value == nil {
+		t.size++
+	}
+	value := loc
+	node.value = &value
+}
+
+// Lookup returns the location of the most specific prefix containing addr.
+func (t *prefixTrie) Lookup(addr netip.Addr) (ClientLocation, bool) {
+	addr = addr.Unmap()
+
+	node := t.root6
+	if addr.Is4() {
+		node = t.root4
+	}
+
+	var best *ClientLocation
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.value != nil {
+			best = node.value
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		bit := (bytes[i/8] >> (7 - uint(i%8))) & 1
+		node = node.children[bit]
+	}
+
+	if best == nil {
+		return ClientLocation{}, false
+	}
+	return *best, true
+}
+
+func (t *prefixTrie) Len() int {
+	return t.size
+}
@@ -0,0 +1,361 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// QueryLogConfig controls structured query logging and dnstap output.
+type QueryLogConfig struct {
+	Output       string // "" (disabled), "stdout" or a file path for JSON lines
+	SampleEvery  int    // write 1 out of every N queries to the structured log
+	DnstapSocket string // Unix socket of a dnstap collector
+	DnstapFile   string // file to write dnstap frame streams to
+	Identity     string // dnstap identity, defaults to the hostname
+}
+
+// queryLogBuffer bounds the events waiting for the writer goroutine; events
+// are dropped rather than slowing down the DNS hot path.
+const queryLogBuffer = 8192
+
+// QueryLogger records every answered query off the hot path: the handler
+// only hands an event to a channel and a background goroutine encodes it.
+type QueryLogger struct {
+	out         *bufio.Writer
+	closer      io.Closer
+	sampleEvery uint64
+	counter     atomic.Uint64
+
+	dnstap   dnstap.Output
+	identity []byte
+
+	events   chan *queryEvent
+	dropped  *uint64
+	done     chan struct{}
+	finished chan struct{}
+}
+
+type queryEvent struct {
+	start    time.Time
+	end      time.Time
+	client   net.Addr
+	query    *dns.Msg
+	response *dns.Msg // nil when served from cache
+	packed   []byte   // cached wire response
+	location string
+	cached   bool
+	sampled  bool
+}
+
+// queryLogEntry is one JSON line of the structured query log.
+type queryLogEntry struct {
+	Time      time.Time `json:"ts"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"proto"`
+	ECS       string    `json:"ecs,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	LatencyUs int64     `json:"latency_us"`
+	Cached    bool      `json:"cached"`
+}
+
+// NewQueryLogger opens the configured outputs. It returns nil when neither
+// structured logging nor dnstap is enabled.
+func NewQueryLogger(cfg QueryLogConfig, dropped *uint64) (*QueryLogger, error) {
+	if cfg.Output == "" && cfg.DnstapSocket == "" && cfg.DnstapFile == "" {
+		return nil, nil
+	}
+
+	l := &QueryLogger{
+		sampleEvery: 1,
+		events:      make(chan *queryEvent, queryLogBuffer),
+		dropped:     dropped,
+		done:        make(chan struct{}),
+		finished:    make(chan struct{}),
+	}
+	if cfg.SampleEvery > 1 {
+		l.sampleEvery = uint64(cfg.SampleEvery)
+	}
+
+	switch cfg.Output {
+	case "":
+	case "stdout":
+		l.out = bufio.NewWriter(os.Stdout)
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open query log: %w", err)
+		}
+		l.out = bufio.NewWriter(f)
+		l.closer = f
+	}
+
+	if cfg.DnstapSocket != "" || cfg.DnstapFile != "" {
+		output, err := newDnstapOutput(cfg)
+		if err != nil {
+			if l.closer != nil {
+				l.closer.Close()
+			}
+			return nil, err
+		}
+		l.dnstap = output
+		go output.RunOutputLoop()
+
+		identity := cfg.Identity
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		l.identity = []byte(identity)
+	}
+
+	go l.run()
+
+	return l, nil
+}
+
+func newDnstapOutput(cfg QueryLogConfig) (dnstap.Output, error) {
+	if cfg.DnstapSocket != "" {
+		addr, err := net.ResolveUnixAddr("unix", cfg.DnstapSocket)
+		if err != nil {
+			return nil, fmt.Errorf("dnstap socket: %w", err)
+		}
+		output, err := dnstap.NewFrameStreamSockOutput(addr)
+		if err != nil {
+			return nil, fmt.Errorf("dnstap socket: %w", err)
+		}
+		log.Printf("[DNS] dnstap output to socket %s", cfg.DnstapSocket)
+		return output, nil
+	}
+
+	output, err := dnstap.NewFrameStreamOutputFromFilename(cfg.DnstapFile)
+	if err != nil {
+		return nil, fmt.Errorf("dnstap file: %w", err)
+	}
+	log.Printf("[DNS] dnstap output to file %s", cfg.DnstapFile)
+	return output, nil
+}
+
+// Log queues an answered query. Exactly one of response and packed is set.
+func (l *QueryLogger) Log(start time.Time, client net.Addr, query, response *dns.Msg, packed []byte, location string, cached bool) {
+	if l == nil {
+		return
+	}
+
+	sampled := l.out != nil && l.counter.Add(1)%l.sampleEvery == 0
+	if !sampled && l.dnstap == nil {
+		return
+	}
+
+	event := &queryEvent{
+		start:    start,
+		end:      time.Now(),
+		client:   client,
+		query:    query,
+		response: response,
+		packed:   packed,
+		location: location,
+		cached:   cached,
+		sampled:  sampled,
+	}
+
+	select {
+	case l.events <- event:
+	default:
+		atomic.AddUint64(l.dropped, 1)
+	}
+}
+
+func (l *QueryLogger) run() {
+	defer close(l.finished)
+
+	encoder := (*json.Encoder)(nil)
+	if l.out != nil {
+		encoder = json.NewEncoder(l.out)
+	}
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case event := <-l.events:
+			l.write(event, encoder)
+		case <-l.done:
+			// Drain what is already queued, then stop
+			for {
+				select {
+				case event := <-l.events:
+					l.write(event, encoder)
+				default:
+					if l.out != nil {
+						l.out.Flush()
+					}
+					return
+				}
+			}
+		case <-flush.C:
+			if l.out != nil {
+				if err := l.out.Flush(); err != nil {
+					log.Printf("[DNS] Error flushing query log: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (l *QueryLogger) write(event *queryEvent, encoder *json.Encoder) {
+	response := event.response
+	if response == nil && event.sampled {
+		response = new(dns.Msg)
+		if err := response.Unpack(event.packed); err != nil {
+			response = nil
+		}
+	}
+
+	if event.sampled && encoder != nil && response != nil {
+		if err := encoder.Encode(newQueryLogEntry(event, response)); err != nil {
+			log.Printf("[DNS] Error writing query log: %v", err)
+		}
+	}
+
+	if l.dnstap != nil {
+		l.writeDnstap(event)
+	}
+}
+
+func newQueryLogEntry(event *queryEvent, response *dns.Msg) queryLogEntry {
+	question := event.query.Question[0]
+
+	entry := queryLogEntry{
+		Time:      event.start.UTC(),
+		QName:     question.Name,
+		QType:     dns.TypeToString[question.Qtype],
+		Client:    extractClientIP(event.client),
+		Protocol:  transportName(event.client),
+		ECS:       clientSubnet(event.query),
+		Location:  event.location,
+		Rcode:     dns.RcodeToString[response.Rcode],
+		LatencyUs: event.end.Sub(event.start).Microseconds(),
+		Cached:    event.cached,
+	}
+
+	for _, rr := range response.Answer {
+		fields := strings.SplitN(rr.String(), "\t", 5)
+		entry.Answers = append(entry.Answers, fields[len(fields)-1])
+	}
+
+	return entry
+}
+
+func (l *QueryLogger) writeDnstap(event *queryEvent) {
+	queryWire, err := event.query.Pack()
+	if err != nil {
+		return
+	}
+	responseWire := event.packed
+	if responseWire == nil {
+		if responseWire, err = event.response.Pack(); err != nil {
+			return
+		}
+	}
+
+	msgType := dnstap.Message_AUTH_RESPONSE
+	message := &dnstap.Message{
+		Type:             &msgType,
+		QueryMessage:     queryWire,
+		ResponseMessage:  responseWire,
+		QueryTimeSec:     proto.Uint64(uint64(event.start.Unix())),
+		QueryTimeNsec:    proto.Uint32(uint32(event.start.Nanosecond())),
+		ResponseTimeSec:  proto.Uint64(uint64(event.end.Unix())),
+		ResponseTimeNsec: proto.Uint32(uint32(event.end.Nanosecond())),
+	}
+
+	var ip net.IP
+	var port int
+	protocol := dnstap.SocketProtocol_UDP
+	switch addr := event.client.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+		protocol = dnstap.SocketProtocol_TCP
+	}
+	if ip != nil {
+		family := dnstap.SocketFamily_INET6
+		if ip4 := ip.To4(); ip4 != nil {
+			family = dnstap.SocketFamily_INET
+			ip = ip4
+		}
+		message.SocketFamily = &family
+		message.QueryAddress = ip
+		message.QueryPort = proto.Uint32(uint32(port))
+	}
+	message.SocketProtocol = &protocol
+
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: l.identity,
+		Version:  []byte("ggkop-agent"),
+		Message:  message,
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.dnstap.GetOutputChannel() <- frame:
+	default:
+		atomic.AddUint64(l.dropped, 1)
+	}
+}
+
+// Close flushes pending events and closes the outputs.
+func (l *QueryLogger) Close() {
+	if l == nil {
+		return
+	}
+	close(l.done)
+	<-l.finished
+	if l.dnstap != nil {
+		l.dnstap.Close()
+	}
+	if l.closer != nil {
+		l.closer.Close()
+	}
+}
+
+// clientSubnet returns the EDNS Client Subnet of a query as CIDR, if present.
+func clientSubnet(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+		}
+	}
+	return ""
+}
+
+func transportName(addr net.Addr) string {
+	if _, ok := addr.(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func testQueryAndResponse(t *testing.T) (*dns.Msg, *dns.Msg) {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.SetEdns0(1232, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4(),
+	})
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	rr, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Answer = append(response.Answer, rr)
+	return query, response
+}
+
+func TestQueryLogger_SampledJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	var dropped uint64
+	logger, err := NewQueryLogger(QueryLogConfig{Output: path, SampleEvery: 2}, &dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, response := testQueryAndResponse(t)
+	packed, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	udpClient := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}
+	tcpClient := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 5353}
+
+	// Every second query is written: the 2nd (fresh) and 4th (cached)
+	logger.Log(start, udpClient, query, response, nil, "", false)
+	logger.Log(start, udpClient, query, response, nil, "de", false)
+	logger.Log(start, tcpClient, query, nil, packed, "", true)
+	logger.Log(start, tcpClient, query, nil, packed, "us-ca", true)
+	logger.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d lines, want 2", len(entries))
+	}
+
+	want := map[string]interface{}{
+		"ts":       "2026-01-02T03:04:05Z",
+		"qname":    "www.example.com.",
+		"qtype":    "A",
+		"client":   "203.0.113.7",
+		"proto":    "udp",
+		"ecs":      "198.51.100.0/24",
+		"location": "de",
+		"rcode":    "NOERROR",
+		"answers":  []interface{}{"192.0.2.10"},
+		"cached":   false,
+	}
+	for key, value := range want {
+		if got, _ := json.Marshal(entries[0][key]); string(got) != mustJSON(t, value) {
+			t.Errorf("%s = %s, want %s", key, got, mustJSON(t, value))
+		}
+	}
+	if _, ok := entries[0]["latency_us"]; !ok {
+		t.Error("latency_us missing")
+	}
+	if entries[1]["proto"] != "tcp" || entries[1]["cached"] != true || entries[1]["location"] != "us-ca" {
+		t.Errorf("cached entry = %v", entries[1])
+	}
+	if dropped != 0 {
+		t.Errorf("dropped = %d, want 0", dropped)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// testDnstapOutput captures frames instead of writing a frame stream.
+type testDnstapOutput struct{ frames chan []byte }
+
+func (o *testDnstapOutput) GetOutputChannel() chan []byte { return o.frames }
+func (o *testDnstapOutput) RunOutputLoop()                {}
+func (o *testDnstapOutput) Close()                        {}
+
+func TestQueryLogger_DnstapMessage(t *testing.T) {
+	output := &testDnstapOutput{frames: make(chan []byte, 1)}
+	var dropped uint64
+	logger := &QueryLogger{dnstap: output, identity: []byte("agent-1"), dropped: &dropped}
+
+	query, response := testQueryAndResponse(t)
+	start := time.Unix(1700000000, 123)
+	logger.writeDnstap(&queryEvent{
+		start:    start,
+		end:      start.Add(time.Millisecond),
+		client:   &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353},
+		query:    query,
+		response: response,
+	})
+
+	var frame dnstap.Dnstap
+	if err := proto.Unmarshal(<-output.frames, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.GetType() != dnstap.Dnstap_MESSAGE || string(frame.GetIdentity()) != "agent-1" {
+		t.Errorf("frame type %v identity %q", frame.GetType(), frame.GetIdentity())
+	}
+
+	message := frame.GetMessage()
+	if message.GetType() != dnstap.Message_AUTH_RESPONSE {
+		t.Errorf("message type = %v, want AUTH_RESPONSE", message.GetType())
+	}
+	if message.GetSocketFamily() != dnstap.SocketFamily_INET || message.GetSocketProtocol() != dnstap.SocketProtocol_TCP {
+		t.Errorf("socket = %v/%v, want INET/TCP", message.GetSocketFamily(), message.GetSocketProtocol())
+	}
+	if !net.IP(message.GetQueryAddress()).Equal(net.ParseIP("203.0.113.7")) || message.GetQueryPort() != 5353 {
+		t.Errorf("query address = %v:%d", net.IP(message.GetQueryAddress()), message.GetQueryPort())
+	}
+	if message.GetQueryTimeSec() != 1700000000 || message.GetQueryTimeNsec() != 123 {
+		t.Errorf("query time = %d.%09d", message.GetQueryTimeSec(), message.GetQueryTimeNsec())
+	}
+	if got := message.GetResponseTimeNsec(); got != 1000123 {
+		t.Errorf("response time nsec = %d, want 1000123", got)
+	}
+
+	var wireResponse dns.Msg
+	if err := wireResponse.Unpack(message.GetResponseMessage()); err != nil || len(wireResponse.Answer) != 1 {
+		t.Errorf("response message = %v (error %v)", wireResponse.Answer, err)
+	}
+}
@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RRLConfig configures DNS Response Rate Limiting. Limits apply to UDP only:
+// TCP clients have completed a handshake and cannot be spoofed.
+type RRLConfig struct {
+	Enabled            bool
+	ResponsesPerSecond int // identical positive answers per client prefix
+	NXDomainsPerSecond int // NXDOMAIN answers per client prefix and zone
+	ErrorsPerSecond    int // other error answers per client prefix
+	Window             int // seconds of burst credit a bucket can hold
+	Slip               int // every Nth limited response is sent truncated (TC=1) instead of dropped; 0 never
+	IPv4PrefixLen      int // clients are grouped into prefixes of these lengths
+	IPv6PrefixLen      int
+	QTypeLimits        map[uint16]int // queries per second per client prefix for specific types
+	TruncateANY        bool           // answer ANY over UDP with TC=1 (RFC 8482 spirit)
+	MaxEntries         int            // bound on tracked buckets
+}
+
+func DefaultRRLConfig() RRLConfig {
+	return RRLConfig{
+		Enabled:            true,
+		ResponsesPerSecond: 20,
+		NXDomainsPerSecond: 10,
+		ErrorsPerSecond:    10,
+		Window:             15,
+		Slip:               2,
+		IPv4PrefixLen:      24,
+		IPv6PrefixLen:      56,
+		QTypeLimits:        map[uint16]int{},
+		TruncateANY:        true,
+		MaxEntries:         100000,
+	}
+}
+
+// ParseQTypeLimits parses "ANY=1,TXT=20" into per-type limits.
+func ParseQTypeLimits(s string) map[uint16]int {
+	limits := make(map[uint16]int)
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		qtype, known := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if !known || err != nil || limit < 0 {
+			continue
+		}
+		limits[qtype] = limit
+	}
+	return limits
+}
+
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// Response kinds are limited independently so a flood of NXDOMAINs cannot
+// starve legitimate answers to the same client prefix.
+type responseKind uint8
+
+const (
+	kindAnswer responseKind = iota
+	kindNXDomain
+	kindError
+)
+
+// RRL holds one token bucket per (client prefix, response kind, name).
+type RRL struct {
+	cfg     RRLConfig
+	buckets *lruCache[string, *tokenBucket]
+	stats   *DNSStats
+}
+
+type tokenBucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited uint64 // responses limited so far, to decide when to slip
+}
+
+func NewRRL(cfg RRLConfig, stats *DNSStats) *RRL {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 1
+	}
+	return &RRL{
+		cfg:     cfg,
+		buckets: newLRUCache[string, *tokenBucket](cfg.MaxEntries),
+		stats:   stats,
+	}
+}
+
+// TruncateANY reports whether ANY queries over UDP get an empty TC=1 reply.
+func (l *RRL) TruncateANY() bool {
+	return l != nil && l.cfg.TruncateANY
+}
+
+// CheckQuery applies per-query-type limits before the query is resolved.
+func (l *RRL) CheckQuery(clientIP string, qtype uint16) rrlAction {
+	if l == nil {
+		return rrlAllow
+	}
+	limit, ok := l.cfg.QTypeLimits[qtype]
+	if !ok {
+		return rrlAllow
+	}
+
+	prefix, ok := l.clientPrefix(clientIP)
+	if !ok {
+		return rrlAllow
+	}
+
+	ok, limited := l.take("q|"+prefix+"|"+strconv.Itoa(int(qtype)), limit)
+	if ok {
+		return rrlAllow
+	}
+	atomic.AddUint64(&l.stats.QTypeLimited, 1)
+	return l.limitedAction(limited)
+}
+
+// CheckResponse applies response rate limits to an answer about to be sent.
+// zone is the configured domain the answer belongs to ("" when unknown).
+func (l *RRL) CheckResponse(clientIP string, qname string, qtype uint16, rcode int, zone string) rrlAction {
+	if l == nil {
+		return rrlAllow
+	}
+
+	prefix, ok := l.clientPrefix(clientIP)
+	if !ok {
+		return rrlAllow
+	}
+
+	var key string
+	var limit int
+	switch kind := classifyResponse(rcode); kind {
+	case kindAnswer:
+		// Identical answers: same name and type
+		key = "a|" + prefix + "|" + qname + "|" + strconv.Itoa(int(qtype))
+		limit = l.cfg.ResponsesPerSecond
+	case kindNXDomain:
+		// Random-subdomain floods vary qname, so key NXDOMAIN on the zone
+		key = "n|" + prefix + "|" + zone
+		limit = l.cfg.NXDomainsPerSecond
+	default:
+		key = "e|" + prefix
+		limit = l.cfg.ErrorsPerSecond
+	}
+
+	if limit <= 0 {
+		return rrlAllow
+	}
+	ok, limited := l.take(key, limit)
+	if ok {
+		return rrlAllow
+	}
+	return l.limitedAction(limited)
+}
+
+// limitedAction slips every Slip-th response limited by the same bucket and
+// drops the others.
+func (l *RRL) limitedAction(limited uint64) rrlAction {
+	if l.cfg.Slip > 0 && limited%uint64(l.cfg.Slip) == 0 {
+		atomic.AddUint64(&l.stats.RRLSlipped, 1)
+		return rrlSlip
+	}
+	atomic.AddUint64(&l.stats.RRLDropped, 1)
+	return rrlDrop
+}
+
+// take removes one token from the bucket for key, refilling it at limit
+// tokens per second up to limit*Window. It reports whether a token was
+// available and, if not, how many responses the bucket has limited so far.
+func (l *RRL) take(key string, limit int) (bool, uint64) {
+	capacity := float64(limit * l.cfg.Window)
+	now := time.Now()
+	bucket := l.buckets.GetOrAdd(key, func() *tokenBucket {
+		return &tokenBucket{tokens: capacity, last: now}
+	}, time.Duration(l.cfg.Window)*time.Second)
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(limit)
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		bucket.limited++
+		return false, bucket.limited
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *RRL) clientPrefix(clientIP string) (string, bool) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+
+	bits := l.cfg.IPv6PrefixLen
+	if addr.Is4() {
+		bits = l.cfg.IPv4PrefixLen
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", false
+	}
+	return prefix.String(), true
+}
+
+func classifyResponse(rcode int) responseKind {
+	switch rcode {
+	case dns.RcodeSuccess:
+		return kindAnswer
+	case dns.RcodeNameError:
+		return kindNXDomain
+	default:
+		return kindError
+	}
+}
+
+// truncatedResponse is the "slip" reply: an empty answer with TC=1 that
+// costs an attacker nothing to reflect but tells real clients to retry over TCP.
+func truncatedResponse(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.Truncated = true
+	return msg
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRRL_LimitsAndSlips(t *testing.T) {
+	cfg := DefaultRRLConfig()
+	cfg.ResponsesPerSecond = 2
+	cfg.Window = 1
+	cfg.Slip = 2
+	stats := &DNSStats{}
+	rrl := NewRRL(cfg, stats)
+
+	var actions []rrlAction
+	for i := 0; i < 5; i++ {
+		actions = append(actions, rrl.CheckResponse("192.0.2.10", "example.com", dns.TypeA, dns.RcodeSuccess, "example.com"))
+	}
+
+	want := []rrlAction{rrlAllow, rrlAllow, rrlDrop, rrlSlip, rrlDrop}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("actions = %v, want %v", actions, want)
+		}
+	}
+	if stats.RRLDropped != 2 || stats.RRLSlipped != 1 {
+		t.Errorf("dropped = %d, slipped = %d, want 2, 1", stats.RRLDropped, stats.RRLSlipped)
+	}
+
+	// Same /24, different name: separate bucket
+	if got := rrl.CheckResponse("192.0.2.99", "www.example.com", dns.TypeA, dns.RcodeSuccess, "example.com"); got != rrlAllow {
+		t.Errorf("different name = %v, want allow", got)
+	}
+	// Same /24 and name: shares the exhausted bucket
+	if got := rrl.CheckResponse("192.0.2.99", "example.com", dns.TypeA, dns.RcodeSuccess, "example.com"); got == rrlAllow {
+		t.Error("same prefix and name was allowed, want limited")
+	}
+}
+
+func TestRRL_SlipCountedPerBucket(t *testing.T) {
+	cfg := DefaultRRLConfig()
+	cfg.ResponsesPerSecond = 1
+	cfg.Window = 1
+	cfg.Slip = 2
+	rrl := NewRRL(cfg, &DNSStats{})
+
+	check := func(client string) rrlAction {
+		return rrl.CheckResponse(client, "example.com", dns.TypeA, dns.RcodeSuccess, "example.com")
+	}
+	for _, client := range []string{"192.0.2.10", "198.51.100.10"} {
+		check(client) // uses the only token
+	}
+
+	// Interleaved limited clients each get their own drop/slip sequence
+	var actions []rrlAction
+	for i := 0; i < 2; i++ {
+		actions = append(actions, check("192.0.2.10"), check("198.51.100.10"))
+	}
+	want := []rrlAction{rrlDrop, rrlDrop, rrlSlip, rrlSlip}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("actions = %v, want %v", actions, want)
+		}
+	}
+}
+
+func TestParseQTypeLimits(t *testing.T) {
+	got := ParseQTypeLimits("ANY=1, txt=20,bogus=3,MX=x")
+	if len(got) != 2 || got[dns.TypeANY] != 1 || got[dns.TypeTXT] != 20 {
+		t.Errorf("ParseQTypeLimits() = %v", got)
+	}
+}
@@ -0,0 +1,461 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SecondaryZone is a zone pulled from an external primary instead of Core.
+type SecondaryZone struct {
+	Zone      string
+	Primaries []string // host or host:port, tried in order
+	TSIGKey   string   // optional key name from TransferConfig.TSIGKeys
+}
+
+const (
+	// secondaryInitialRetry is used until the first transfer succeeds.
+	secondaryInitialRetry = 30 * time.Second
+	secondaryTimeout      = 10 * time.Second
+)
+
+// ParseSecondaryZones parses "zone=primary;primary2,zone2=primary" and
+// applies tsigKey (may be empty) to every zone.
+func ParseSecondaryZones(s, tsigKey string) ([]SecondaryZone, error) {
+	var zones []SecondaryZone
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		zone, primaries, ok := strings.Cut(part, "=")
+		if !ok || zone == "" || primaries == "" {
+			return nil, fmt.Errorf("invalid secondary zone %q, want zone=primary[;primary]", part)
+		}
+
+		secondary := SecondaryZone{Zone: zone, TSIGKey: tsigKey}
+		for _, primary := range strings.Split(primaries, ";") {
+			if primary = strings.TrimSpace(primary); primary != "" {
+				secondary.Primaries = append(secondary.Primaries, withDefaultPort(primary))
+			}
+		}
+		zones = append(zones, secondary)
+	}
+	return zones, nil
+}
+
+// SecondaryZones keeps secondary zones in sync with their primaries: SOA
+// refresh on the zone's timers, IXFR with AXFR fallback, and immediate
+// refresh when a primary sends NOTIFY.
+type SecondaryZones struct {
+	zones    map[string]*secondaryZone // keyed by lower-case FQDN
+	onChange func()
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type secondaryZone struct {
+	name      string
+	primaries []string
+	keyName   string
+	secret    string
+	notify    chan struct{}
+
+	mu        sync.RWMutex
+	data      *zoneData
+	expiresAt time.Time
+}
+
+// zoneData is an immutable copy of a transferred zone.
+type zoneData struct {
+	soa     *dns.SOA
+	records []dns.RR            // all records except the SOA
+	names   map[string][]dns.RR // lower-case owner -> records, SOA included
+}
+
+// NewSecondaryZones starts syncing zones. onChange is called whenever a zone
+// is loaded, updated or expires. It returns nil when zones is empty.
+func NewSecondaryZones(zones []SecondaryZone, tsigKeys map[string]string, onChange func()) (*SecondaryZones, error) {
+	if len(zones) == 0 {
+		return nil, nil
+	}
+
+	s := &SecondaryZones{
+		zones:    make(map[string]*secondaryZone, len(zones)),
+		onChange: onChange,
+		done:     make(chan struct{}),
+	}
+
+	for _, cfg := range zones {
+		if len(cfg.Primaries) == 0 {
+			return nil, fmt.Errorf("secondary zone %s has no primaries", cfg.Zone)
+		}
+		zone := &secondaryZone{
+			name:      dns.CanonicalName(cfg.Zone),
+			primaries: cfg.Primaries,
+			notify:    make(chan struct{}, 1),
+		}
+		if cfg.TSIGKey != "" {
+			zone.keyName = dns.CanonicalName(cfg.TSIGKey)
+			secret, ok := tsigKeys[zone.keyName]
+			if !ok {
+				return nil, fmt.Errorf("secondary zone %s: unknown TSIG key %s", cfg.Zone, cfg.TSIGKey)
+			}
+			zone.secret = secret
+		}
+		s.zones[zone.name] = zone
+	}
+
+	for _, zone := range s.zones {
+		s.wg.Add(1)
+		go func(zone *secondaryZone) {
+			defer s.wg.Done()
+			s.run(zone)
+		}(zone)
+	}
+
+	return s, nil
+}
+
+// Close stops refreshing. Zones already loaded keep being served.
+func (s *SecondaryZones) Close() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+}
+
+// Answer builds the response to r if its name falls into a secondary zone.
+func (s *SecondaryZones) Answer(r *dns.Msg) (*dns.Msg, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	zone := s.zoneFor(r.Question[0].Name)
+	if zone == nil {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+
+	zone.mu.RLock()
+	data := zone.data
+	zone.mu.RUnlock()
+
+	if data == nil {
+		// Not loaded yet or expired
+		msg.Rcode = dns.RcodeServerFailure
+		return msg, true
+	}
+
+	msg.Authoritative = true
+	question := r.Question[0]
+	rrs, exists := data.names[strings.ToLower(question.Name)]
+	if !exists {
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = []dns.RR{data.soa}
+		return msg, true
+	}
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == question.Qtype {
+			msg.Answer = append(msg.Answer, ownedBy(rr, question.Name))
+		}
+	}
+	if len(msg.Answer) == 0 {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				msg.Answer = append(msg.Answer, ownedBy(rr, question.Name))
+			}
+		}
+	}
+	if len(msg.Answer) == 0 {
+		// NODATA
+		msg.Ns = []dns.RR{data.soa}
+	}
+
+	return msg, true
+}
+
+// HandleNotify processes a NOTIFY from a primary and reports whether it was
+// accepted. A NOTIFY is accepted from a listed primary, or from anywhere when
+// it carries a valid TSIG with the zone's key.
+func (s *SecondaryZones) HandleNotify(w dns.ResponseWriter, r *dns.Msg) bool {
+	if s == nil {
+		return false
+	}
+
+	zone, ok := s.zones[dns.CanonicalName(r.Question[0].Name)]
+	if !ok {
+		return false
+	}
+
+	authorized := false
+	if tsig := r.IsTsig(); tsig != nil && zone.keyName != "" {
+		authorized = w.TsigStatus() == nil && dns.CanonicalName(tsig.Hdr.Name) == zone.keyName
+	} else if zone.keyName == "" {
+		client := extractClientIP(w.RemoteAddr())
+		for _, primary := range zone.primaries {
+			if host, _, err := net.SplitHostPort(primary); err == nil && net.ParseIP(host).Equal(net.ParseIP(client)) {
+				authorized = true
+				break
+			}
+		}
+	}
+	if !authorized {
+		return false
+	}
+
+	select {
+	case zone.notify <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+	return true
+}
+
+func (s *SecondaryZones) zoneFor(name string) *secondaryZone {
+	name = dns.CanonicalName(name)
+	for {
+		if zone, ok := s.zones[name]; ok {
+			return zone
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+func (s *SecondaryZones) run(zone *secondaryZone) {
+	for {
+		timer := time.NewTimer(s.refresh(zone))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-zone.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh syncs zone with its primaries and returns when to check again.
+func (s *SecondaryZones) refresh(zone *secondaryZone) time.Duration {
+	zone.mu.RLock()
+	current := zone.data
+	expiresAt := zone.expiresAt
+	zone.mu.RUnlock()
+
+	var err error
+	for _, primary := range zone.primaries {
+		var updated *zoneData
+		if updated, err = zone.sync(primary, current); err == nil {
+			zone.mu.Lock()
+			zone.data = updated
+			zone.expiresAt = time.Now().Add(time.Duration(updated.soa.Expire) * time.Second)
+			zone.mu.Unlock()
+
+			if updated != current {
+				log.Printf("[DNS] Secondary zone %s loaded from %s: serial %d, %d records",
+					zone.name, primary, updated.soa.Serial, len(updated.records))
+				s.onChange()
+			}
+			return time.Duration(updated.soa.Refresh) * time.Second
+		}
+		log.Printf("[DNS] Secondary zone %s: refresh from %s failed: %v", zone.name, primary, err)
+	}
+
+	if current == nil {
+		return secondaryInitialRetry
+	}
+	if time.Now().After(expiresAt) {
+		zone.mu.Lock()
+		zone.data = nil
+		zone.mu.Unlock()
+		log.Printf("[DNS] Secondary zone %s expired, answering SERVFAIL until a primary is reachable", zone.name)
+		s.onChange()
+		return secondaryInitialRetry
+	}
+	return time.Duration(current.soa.Retry) * time.Second
+}
+
+// sync returns the zone's data after checking primary: current itself when it
+// is up to date, otherwise the result of an IXFR (or AXFR when there is no
+// current copy).
+func (z *secondaryZone) sync(primary string, current *zoneData) (*zoneData, error) {
+	if current != nil {
+		serial, err := z.primarySerial(primary)
+		if err != nil {
+			return nil, err
+		}
+		// Any other serial is newer: Core zones carry content hashes
+		if serial == current.soa.Serial {
+			return current, nil
+		}
+	}
+
+	msg := new(dns.Msg)
+	if current != nil {
+		msg.SetIxfr(z.name, current.soa.Serial, current.soa.Ns, current.soa.Mbox)
+	} else {
+		msg.SetAxfr(z.name)
+	}
+
+	tr := &dns.Transfer{DialTimeout: secondaryTimeout, ReadTimeout: secondaryTimeout}
+	if z.keyName != "" {
+		tr.TsigSecret = map[string]string{z.keyName: z.secret}
+		msg.SetTsig(z.keyName, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	envelopes, err := tr.In(msg, primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			if dns.IsSubDomain(z.name, rr.Header().Name) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+
+	return applyTransfer(current, rrs)
+}
+
+func (z *secondaryZone) primarySerial(primary string) (uint32, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(z.name, dns.TypeSOA)
+
+	client := &dns.Client{Timeout: secondaryTimeout}
+	if z.keyName != "" {
+		client.TsigSecret = map[string]string{z.keyName: z.secret}
+		msg.SetTsig(z.keyName, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.Exchange(msg, primary)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(msg, primary)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA in answer")
+}
+
+// applyTransfer builds zone data from an AXFR or IXFR answer (RFC 1995: an
+// IXFR answer may itself be a full zone).
+func applyTransfer(current *zoneData, rrs []dns.RR) (*zoneData, error) {
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("transfer does not start with SOA")
+	}
+
+	if len(rrs) == 1 {
+		if current == nil {
+			return nil, errors.New("primary sent only the SOA")
+		}
+		return current, nil
+	}
+
+	if _, last := rrs[len(rrs)-1].(*dns.SOA); !last {
+		return nil, errors.New("transfer does not end with SOA")
+	}
+
+	_, incremental := rrs[1].(*dns.SOA)
+	if !incremental || current == nil || len(rrs) == 2 {
+		return newZoneData(soa, rrs[1:len(rrs)-1]), nil
+	}
+
+	set := make(map[string]dns.RR, len(current.records))
+	for _, rr := range current.records {
+		set[rrKey(rr)] = rr
+	}
+
+	i := 1
+	for i < len(rrs)-1 {
+		i++ // old SOA of this difference
+		for ; i < len(rrs) && rrs[i].Header().Rrtype != dns.TypeSOA; i++ {
+			delete(set, rrKey(rrs[i]))
+		}
+		if i >= len(rrs)-1 {
+			return nil, errors.New("malformed IXFR: difference without new SOA")
+		}
+		i++ // new SOA of this difference
+		for ; i < len(rrs) && rrs[i].Header().Rrtype != dns.TypeSOA; i++ {
+			set[rrKey(rrs[i])] = rrs[i]
+		}
+	}
+
+	records := make([]dns.RR, 0, len(set))
+	for _, rr := range set {
+		records = append(records, rr)
+	}
+	return newZoneData(soa, records), nil
+}
+
+func newZoneData(soa *dns.SOA, records []dns.RR) *zoneData {
+	data := &zoneData{
+		soa:     soa,
+		records: records,
+		names:   make(map[string][]dns.RR),
+	}
+
+	apex := strings.ToLower(soa.Hdr.Name)
+	data.names[apex] = append(data.names[apex], soa)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		data.names[name] = append(data.names[name], rr)
+	}
+	return data
+}
+
+// rrKey identifies a record for IXFR deletions, which match regardless of TTL.
+func rrKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Ttl = 0
+	c.Header().Name = strings.ToLower(c.Header().Name)
+	return c.String()
+}
+
+// ownedBy returns a copy of rr owned by name, keeping the query's casing.
+func ownedBy(rr dns.RR, name string) dns.RR {
+	c := dns.Copy(rr)
+	c.Header().Name = name
+	return c
+}
+
+// withDefaultPort appends port 53 to a bare host or IP.
+func withDefaultPort(target string) string {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return net.JoinHostPort(target, "53")
+	}
+	return target
+}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+	"github.com/miekg/dns"
+)
+
+// startPrimary serves SOA queries and transfers for zones on one UDP and TCP
+// port, standing in for an external primary.
+func startPrimary(t *testing.T, zones *ZoneStore) string {
+	t.Helper()
+
+	primary := &DNSServer{
+		stats:    &DNSStats{},
+		zones:    zones,
+		transfer: TransferConfig{AllowFrom: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeSOA {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = []dns.RR{zones.SOA(cleanDomain(r.Question[0].Name))}
+			w.WriteMsg(msg)
+			return
+		}
+		primary.handleTransfer(w, r)
+	})
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		t.Skipf("cannot bind TCP on the UDP port: %v", err)
+	}
+
+	udp := &dns.Server{PacketConn: packetConn, Handler: handler}
+	tcp := &dns.Server{Listener: listener, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+
+	return packetConn.LocalAddr().String()
+}
+
+func TestSecondaryZones_TransferAndIXFR(t *testing.T) {
+	zones := NewZoneStore()
+	zones.Update([]config.Domain{testDomain("192.0.2.1")})
+	addr := startPrimary(t, zones)
+
+	zone := &secondaryZone{name: "example.com.", primaries: []string{addr}, notify: make(chan struct{}, 1)}
+	changes := 0
+	secondaries := &SecondaryZones{
+		zones:    map[string]*secondaryZone{zone.name: zone},
+		onChange: func() { changes++ },
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		msg, ok := secondaries.Answer(r)
+		if !ok {
+			t.Fatalf("%s not answered by secondary zones", name)
+		}
+		return msg
+	}
+
+	if msg := query("example.com.", dns.TypeA); msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("before load rcode = %s, want SERVFAIL", dns.RcodeToString[msg.Rcode])
+	}
+
+	// Initial AXFR
+	secondaries.refresh(zone)
+	if msg := query("Example.com.", dns.TypeA); len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("after AXFR answer = %v", msg.Answer)
+	}
+	if msg := query("www.example.com.", dns.TypeA); len(msg.Answer) != 1 || msg.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("www A answer = %v, want the CNAME", msg.Answer)
+	}
+	if msg := query("missing.example.com.", dns.TypeA); msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 1 {
+		t.Errorf("missing name rcode = %s, authority = %v; want NXDOMAIN with SOA", dns.RcodeToString[msg.Rcode], msg.Ns)
+	}
+
+	// Up to date: nothing changes
+	secondaries.refresh(zone)
+	if changes != 1 {
+		t.Errorf("onChange called %d times, want 1", changes)
+	}
+
+	// The primary changes and the secondary catches up through IXFR
+	zones.Update([]config.Domain{testDomain("192.0.2.2")})
+	secondaries.refresh(zone)
+	if msg := query("example.com.", dns.TypeA); len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("after IXFR answer = %v", msg.Answer)
+	}
+	if msg := query("example.com.", dns.TypeSOA); msg.Answer[0].(*dns.SOA).Serial != zones.SOA("example.com").Serial {
+		t.Errorf("secondary SOA = %v, want serial %d", msg.Answer[0], zones.SOA("example.com").Serial)
+	}
+	if changes != 2 {
+		t.Errorf("onChange called %d times, want 2", changes)
+	}
+}
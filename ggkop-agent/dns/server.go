@@ -1,10 +1,16 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ggkop/agent/config"
 	"github.com/miekg/dns"
@@ -13,63 +19,238 @@ import (
 type DNSServer struct {
 	configMgr *config.ConfigManager
 	geoIP     *GeoIPService
+	overrides *GeoIPOverrides
 	cache     *DNSCache
+	queryLog  *QueryLogger
+	rrl       *RRL
 	stats     *DNSStats
+	udpSize   uint16
+	nsid      string
+	zones     *ZoneStore
+	transfer  TransferConfig
+
+	secondaries *SecondaryZones
+	servers     []*dns.Server
+	challenges  acmeChallenges
 }
 
 type DNSStats struct {
-	TotalQueries  uint64
-	CacheHits     uint64
-	CacheMisses   uint64
-	GeoDNSQueries uint64
-	NXDomain      uint64
+	TotalQueries    uint64
+	CacheHits       uint64
+	CacheMisses     uint64
+	GeoDNSQueries   uint64
+	NXDomain        uint64
+	QueryLogDropped uint64
+	RRLDropped      uint64 // responses dropped by rate limiting
+	RRLSlipped      uint64 // responses replaced by a truncated (TC=1) reply
+	QTypeLimited    uint64 // queries over a per-query-type limit
+	ANYTruncated    uint64 // ANY queries over UDP answered with TC=1
+	Truncated       uint64 // responses cut down to the client's UDP size
+	Rejected        uint64 // FORMERR, NOTIMP and BADVERS replies
 }
 
-func StartDNSServer(configMgr *config.ConfigManager) {
-	geoIP, err := NewGeoIPService("GeoLite2-City.mmdb")
-	if err != nil {
-		log.Printf("[DNS] Warning: GeoIP service not available: %v", err)
-		log.Println("[DNS] GeoDNS will use fallback logic")
-	}
+// Config holds the agent-local DNS server settings (everything that does not
+// come from Core).
+type Config struct {
+	ListenAddrs []string // UDP and TCP addresses, ":53" when empty
+	GeoIP       GeoIPConfig
+	CacheSize   int
+	QueryLog    QueryLogConfig
+	RRL         RRLConfig
+	UDPSize     uint16 // advertised EDNS buffer size, DefaultUDPSize when 0
+	NSID        string // returned to clients that send the NSID option
+	Transfer    TransferConfig
+	Secondary   []SecondaryZone
+	DoT         bool     // serve DNS over TLS
+	DoTAddrs    []string // DoT addresses, ":853" when empty
+	TLSDomain   string   // domain whose certificate DoT clients without SNI get
+}
 
+// StartDNSServer binds every configured listener, then serves in the
+// background. A bind failure is returned before anything is started. The
+// server also answers DNS-over-HTTPS as an http.Handler.
+func StartDNSServer(configMgr *config.ConfigManager, cfg Config) (*DNSServer, error) {
 	server := &DNSServer{
 		configMgr: configMgr,
-		geoIP:     geoIP,
-		cache:     NewDNSCache(10000),
+		cache:     NewDNSCache(cfg.CacheSize),
 		stats:     &DNSStats{},
+		udpSize:   cfg.UDPSize,
+		nsid:      cfg.NSID,
+		zones:     NewZoneStore(),
+		transfer:  cfg.Transfer,
+	}
+	if server.udpSize < minUDPSize {
+		server.udpSize = DefaultUDPSize
+	}
+
+	if err := server.listen(cfg); err != nil {
+		return nil, err
 	}
 
-	dns.HandleFunc(".", server.handleDNSRequest)
+	geoIPConfig := cfg.GeoIP
+	server.geoIP = NewGeoIPService(geoIPConfig)
 
-	udpServer := &dns.Server{Addr: ":53", Net: "udp"}
-	tcpServer := &dns.Server{Addr: ":53", Net: "tcp"}
+	overrides := NewGeoIPOverrides(geoIPConfig.OverridesFile)
+	overrides.SetConfigEntries(configMgr.GetConfig().GeoIPOverrides)
+	go overrides.WatchFile(geoIPConfig.ReloadInterval)
+	server.overrides = overrides
 
-	go func() {
-		log.Println("[DNS] Starting UDP server on :53")
-		if err := udpServer.ListenAndServe(); err != nil {
-			log.Fatalf("[DNS] Failed to start UDP server: %v", err)
+	server.rrl = NewRRL(cfg.RRL, server.stats)
+
+	var err error
+	server.secondaries, err = NewSecondaryZones(cfg.Secondary, cfg.Transfer.TSIGKeys, server.cache.Purge)
+	if err != nil {
+		log.Printf("[DNS] Warning: secondary zones disabled: %v", err)
+	}
+
+	server.queryLog, err = NewQueryLogger(cfg.QueryLog, &server.stats.QueryLogDropped)
+	if err != nil {
+		log.Printf("[DNS] Warning: query logging disabled: %v", err)
+	}
+
+	// Cached answers are only valid for the configuration they were built from
+	var revision atomic.Uint64
+	revision.Store(configMgr.GetConfig().Revision)
+	server.zones.Update(configMgr.GetAllDomains())
+	configMgr.OnUpdate(func(cfg *config.Config) {
+		overrides.SetConfigEntries(cfg.GeoIPOverrides)
+		if revision.Swap(cfg.Revision) != cfg.Revision {
+			changed := server.zones.Update(configMgr.GetAllDomains())
+			// After the zones, so nothing resolved before the update is cached
+			server.cache.Purge()
+			log.Printf("[DNS] Configuration changed (revision %d), answer cache purged", cfg.Revision)
+
+			if len(changed) > 0 {
+				log.Printf("[DNS] Zones changed: %s", strings.Join(changed, ", "))
+				server.notifySecondaries(changed)
+			}
 		}
-	}()
+	})
+
+	// Wait until every server is running so an early Shutdown can stop them
+	var started sync.WaitGroup
+	for _, srv := range server.servers {
+		started.Add(1)
+		var once sync.Once
+		srv.NotifyStartedFunc = func() { once.Do(started.Done) }
+		go func(srv *dns.Server, done func()) {
+			defer done()
+			log.Printf("[DNS] Serving %s on %s", srv.Net, serverAddr(srv))
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Printf("[DNS] %s server on %s stopped: %v", srv.Net, serverAddr(srv), err)
+			}
+		}(srv, srv.NotifyStartedFunc)
+	}
+	started.Wait()
 
-	go func() {
-		log.Println("[DNS] Starting TCP server on :53")
-		if err := tcpServer.ListenAndServe(); err != nil {
-			log.Fatalf("[DNS] Failed to start TCP server: %v", err)
+	return server, nil
+}
+
+// listen binds UDP and TCP on every listen address, plus DoT when enabled.
+// On failure everything bound so far is closed again.
+func (s *DNSServer) listen(cfg Config) error {
+	addrs := cfg.ListenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{":53"}
+	}
+	dotAddrs := cfg.DoTAddrs
+	if len(dotAddrs) == 0 {
+		dotAddrs = []string{":853"}
+	}
+
+	handler := dns.HandlerFunc(s.handleDNSRequest)
+	newServer := func(network string) *dns.Server {
+		srv := &dns.Server{Net: network, Handler: handler, TsigSecret: cfg.Transfer.TSIGKeys}
+		s.servers = append(s.servers, srv)
+		return srv
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("DNS: %w", err)
+		}
+		newServer("udp").PacketConn = conn
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("DNS: %w", err)
+		}
+		newServer("tcp").Listener = listener
+	}
+
+	if cfg.DoT {
+		tlsConfig := s.tlsConfig(cfg.TLSDomain)
+		for _, addr := range dotAddrs {
+			listener, err := tls.Listen("tcp", addr, tlsConfig)
+			if err != nil {
+				s.closeListeners()
+				return fmt.Errorf("DNS over TLS: %w", err)
+			}
+			newServer("tcp-tls").Listener = listener
 		}
-	}()
+	}
+
+	return nil
+}
+
+func (s *DNSServer) closeListeners() {
+	for _, srv := range s.servers {
+		if srv.PacketConn != nil {
+			srv.PacketConn.Close()
+		}
+		if srv.Listener != nil {
+			srv.Listener.Close()
+		}
+	}
+	s.servers = nil
+}
+
+func serverAddr(srv *dns.Server) net.Addr {
+	if srv.PacketConn != nil {
+		return srv.PacketConn.LocalAddr()
+	}
+	return srv.Listener.Addr()
+}
+
+// Shutdown stops accepting queries, waits for in-flight queries and TCP
+// sessions until ctx expires, and flushes the query log.
+func (s *DNSServer) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, srv := range s.servers {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", srv.Net, serverAddr(srv), err))
+		}
+	}
+	s.secondaries.Close()
+	s.queryLog.Close()
+	return errors.Join(errs...)
+}
+
+// Close releases the GeoIP databases. DoH requests keep resolving locations
+// after Shutdown, so call it once the HTTPS proxy has stopped as well.
+func (s *DNSServer) Close() error {
+	return s.geoIP.Close()
 }
 
 func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
 	atomic.AddUint64(&s.stats.TotalQueries, 1)
 
-	msg := new(dns.Msg)
-	msg.SetReply(r)
-	msg.Authoritative = true
+	udp := isUDP(w.RemoteAddr())
 
-	if len(r.Question) == 0 {
-		if err := w.WriteMsg(msg); err != nil {
-			log.Printf("[DNS] Error writing response: %v", err)
-		}
+	if rcode := validateRequest(r); rcode != dns.RcodeSuccess {
+		atomic.AddUint64(&s.stats.Rejected, 1)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, rcode)
+		s.writeResponse(w, r, msg, udp)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeNotify {
+		s.handleNotify(w, r)
 		return
 	}
 
@@ -77,58 +258,163 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	domain := cleanDomain(question.Name)
 	qtype := question.Qtype
 
-	log.Printf("[DNS] Query: %s %s from %s", domain, dns.TypeToString[qtype], w.RemoteAddr())
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		s.handleTransfer(w, r)
+		return
+	}
 
 	clientIP := extractClientIP(w.RemoteAddr())
 
+	if udp {
+		if qtype == dns.TypeANY && s.rrl.TruncateANY() {
+			atomic.AddUint64(&s.stats.ANYTruncated, 1)
+			s.writeResponse(w, r, truncatedResponse(r), udp)
+			return
+		}
+		if s.applyRateLimit(w, r, s.rrl.CheckQuery(clientIP, qtype)) {
+			return
+		}
+	}
+
+	if packed, location, ok := s.cachedResponse(r, domain, qtype, clientIP); ok {
+		atomic.AddUint64(&s.stats.CacheHits, 1)
+		rcode := int(packed[3] & 0x0F)
+		if udp && s.applyRateLimit(w, r, s.rrl.CheckResponse(clientIP, domain, qtype, rcode, zoneOf(domain))) {
+			return
+		}
+		packed, err := s.finishPacked(r, packed, udp)
+		if err != nil {
+			log.Printf("[DNS] Error preparing cached response: %v", err)
+			return
+		}
+		if _, err := w.Write(packed); err != nil {
+			log.Printf("[DNS] Error writing cached response: %v", err)
+		}
+		s.queryLog.Log(start, w.RemoteAddr(), r, nil, packed, location, true)
+		return
+	}
+	atomic.AddUint64(&s.stats.CacheMisses, 1)
+
+	generation := s.cache.Generation()
+	msg, geo, location := s.resolve(r, domain, clientIP)
+	if msg.Rcode == dns.RcodeNameError {
+		atomic.AddUint64(&s.stats.NXDomain, 1)
+	}
+
+	locationKey := ""
+	if geo {
+		locationKey = location.String()
+		s.cache.SetGeo(domain, qtype, generation)
+	}
+	s.cache.Set(domain, qtype, locationKey, msg, generation)
+
+	if udp && s.applyRateLimit(w, r, s.rrl.CheckResponse(clientIP, domain, qtype, msg.Rcode, zoneOf(domain))) {
+		return
+	}
+
+	s.writeResponse(w, r, msg, udp)
+	s.queryLog.Log(start, w.RemoteAddr(), r, msg, nil, locationKey, false)
+}
+
+// applyRateLimit carries out an RRL decision. It reports whether the normal
+// response must not be sent.
+func (s *DNSServer) applyRateLimit(w dns.ResponseWriter, r *dns.Msg, action rrlAction) bool {
+	switch action {
+	case rrlDrop:
+		return true
+	case rrlSlip:
+		s.writeResponse(w, r, truncatedResponse(r), true)
+		return true
+	default:
+		return false
+	}
+}
+
+// writeResponse sends msg after EDNS negotiation and truncation. msg must
+// not be modified afterwards by the caller.
+func (s *DNSServer) writeResponse(w dns.ResponseWriter, r, msg *dns.Msg, udp bool) {
+	s.finishResponse(r, msg, udp)
+	if err := w.WriteMsg(msg); err != nil {
+		log.Printf("[DNS] Error writing response: %v", err)
+	}
+}
+
+// cachedResponse returns a ready-to-send cached answer for r. GeoDNS names
+// are cached per client location, so the location is only looked up for
+// names already known to be geo-routed.
+func (s *DNSServer) cachedResponse(r *dns.Msg, domain string, qtype uint16, clientIP string) ([]byte, string, bool) {
+	entry, ok := s.cache.Get(domain, qtype, "")
+	if !ok {
+		return nil, "", false
+	}
+
+	locationKey := ""
+	if entry.geo {
+		locationKey = s.lookupClientLocation(clientIP).String()
+		entry, ok = s.cache.Get(domain, qtype, locationKey)
+		if !ok {
+			return nil, "", false
+		}
+		atomic.AddUint64(&s.stats.GeoDNSQueries, 1)
+	}
+
+	packed, err := entry.responseFor(r)
+	if err != nil {
+		log.Printf("[DNS] Error preparing cached response: %v", err)
+		return nil, "", false
+	}
+
+	if entry.rcode == dns.RcodeNameError {
+		atomic.AddUint64(&s.stats.NXDomain, 1)
+	}
+	return packed, locationKey, true
+}
+
+// resolve builds the answer for r from the current configuration. geo reports
+// whether the answer depends on the client location.
+func (s *DNSServer) resolve(r *dns.Msg, domain string, clientIP string) (*dns.Msg, bool, ClientLocation) {
+	qtype := r.Question[0].Qtype
+
+	if msg, ok := s.acmeChallengeResponse(r, domain); ok {
+		return msg, false, ClientLocation{}
+	}
+
+	// Zones pulled from an external primary take precedence
+	if msg, ok := s.secondaries.Answer(r); ok {
+		return msg, false, ClientLocation{}
+	}
+
 	// Try to find exact domain match first
 	domainConfig := s.configMgr.GetDomain(domain)
-	
+
 	// If not found, try to find parent domain (for subdomains like _acme-challenge.example.com)
 	if domainConfig == nil {
 		parentDomain := extractParentDomain(domain)
 		if parentDomain != "" {
 			domainConfig = s.configMgr.GetDomain(parentDomain)
-			log.Printf("[DNS] Exact match not found for %s, trying parent domain: %s", domain, parentDomain)
 		}
 	}
-	
+
 	if domainConfig == nil {
-		log.Printf("[DNS] Domain not found: %s", domain)
-		atomic.AddUint64(&s.stats.NXDomain, 1)
-		s.sendNXDOMAIN(w, r)
-		return
+		return nxdomainResponse(r), false, ClientLocation{}
 	}
 
 	// Use GeoDNS if we have GeoDNS map and this is an A query for the main domain
-	queryName := cleanDomain(question.Name)
-	if qtype == dns.TypeA && len(domainConfig.GeoDNSMap) > 0 && queryName == domainConfig.Domain {
+	if qtype == dns.TypeA && len(domainConfig.GeoDNSMap) > 0 && domain == domainConfig.Domain {
 		atomic.AddUint64(&s.stats.GeoDNSQueries, 1)
-		log.Printf("[DNS] Using GeoDNS for %s (map size: %d)", domain, len(domainConfig.GeoDNSMap))
-		s.handleGeoDNSQuery(w, r, domainConfig, clientIP)
-		return
+
+		clientLocation := s.lookupClientLocation(clientIP)
+		return s.geoDNSResponse(r, domainConfig, clientLocation), true, clientLocation
 	}
 
-	s.handleRegularDNSQuery(w, r, domainConfig)
+	return s.regularDNSResponse(r, domainConfig), false, ClientLocation{}
 }
 
-func (s *DNSServer) handleGeoDNSQuery(w dns.ResponseWriter, r *dns.Msg, domainConfig *config.Domain, clientIP string) {
+func (s *DNSServer) geoDNSResponse(r *dns.Msg, domainConfig *config.Domain, clientLocation ClientLocation) *dns.Msg {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Authoritative = true
 
-	clientLocation := "default"
-	if s.geoIP != nil {
-		detectedLocation := s.geoIP.GetLocation(clientIP)
-		if detectedLocation != "" {
-			clientLocation = detectedLocation
-			log.Printf("[DNS] Client %s detected as location: %s", clientIP, clientLocation)
-		}
-	}
-
-	log.Printf("[DNS] GeoDNS Query: %s from %s (location: %s)", domainConfig.Domain, clientIP, clientLocation)
-	log.Printf("[DNS] GeoDNS Map: %+v", domainConfig.GeoDNSMap)
-
 	agentIP := findBestAgentIP(domainConfig.GeoDNSMap, clientLocation)
 	if agentIP == "" {
 		log.Printf("[DNS] No agent IP found in GeoDNS map for location: %s", clientLocation)
@@ -144,19 +430,15 @@ func (s *DNSServer) handleGeoDNSQuery(w dns.ResponseWriter, r *dns.Msg, domainCo
 
 		if agentIP == "" {
 			log.Printf("[DNS] No A records available for fallback")
-			s.sendNXDOMAIN(w, r)
-			return
+			return nxdomainResponse(r)
 		}
 	}
 
-	log.Printf("[DNS] GeoDNS Response: %s (location: %s) → %s", domainConfig.Domain, clientLocation, agentIP)
-
 	// Validate IP before creating response
 	parsedIP := net.ParseIP(agentIP)
 	if parsedIP == nil {
 		log.Printf("[DNS] ERROR: Invalid IP address in GeoDNS response: %s", agentIP)
-		s.sendNXDOMAIN(w, r)
-		return
+		return nxdomainResponse(r)
 	}
 
 	msg.Answer = append(msg.Answer, &dns.A{
@@ -169,12 +451,19 @@ func (s *DNSServer) handleGeoDNSQuery(w dns.ResponseWriter, r *dns.Msg, domainCo
 		A: parsedIP,
 	})
 
-	if err := w.WriteMsg(msg); err != nil {
-		log.Printf("[DNS] Error writing response: %v", err)
+	return msg
+}
+
+// lookupClientLocation resolves a client IP via the override table first and
+// falls back to the MaxMind databases.
+func (s *DNSServer) lookupClientLocation(clientIP string) ClientLocation {
+	if loc, ok := s.overrides.Lookup(clientIP); ok {
+		return loc
 	}
+	return s.geoIP.GetLocation(clientIP)
 }
 
-func (s *DNSServer) handleRegularDNSQuery(w dns.ResponseWriter, r *dns.Msg, domainConfig *config.Domain) {
+func (s *DNSServer) regularDNSResponse(r *dns.Msg, domainConfig *config.Domain) *dns.Msg {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Authoritative = true
@@ -183,107 +472,34 @@ func (s *DNSServer) handleRegularDNSQuery(w dns.ResponseWriter, r *dns.Msg, doma
 	qtype := question.Qtype
 	queryName := cleanDomain(question.Name)
 
-	log.Printf("[DNS] Regular query for %s (type: %s), have %d DNS records",
-		queryName, dns.TypeToString[qtype], len(domainConfig.DNSRecords))
-
-	for _, record := range domainConfig.DNSRecords {
-		recordName := record.Name
-		if recordName == "@" {
-			recordName = domainConfig.Domain
-		} else if !strings.HasSuffix(recordName, ".") {
-			recordName = recordName + "." + domainConfig.Domain
+	if qtype == dns.TypeSOA && queryName == domainConfig.Domain {
+		if soa := s.zones.SOA(domainConfig.Domain); soa != nil {
+			msg.Answer = append(msg.Answer, soa)
+			return msg
 		}
+	}
 
-		if recordName != queryName {
+	for _, record := range domainConfig.DNSRecords {
+		if recordOwner(record, domainConfig.Domain) != queryName || record.Type != dns.TypeToString[qtype] {
 			continue
 		}
-
-		switch qtype {
-		case dns.TypeA:
-			if record.Type == "A" {
-				msg.Answer = append(msg.Answer, &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   question.Name,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    record.TTL,
-					},
-					A: net.ParseIP(record.Value),
-				})
-			}
-
-		case dns.TypeAAAA:
-			if record.Type == "AAAA" {
-				msg.Answer = append(msg.Answer, &dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:   question.Name,
-						Rrtype: dns.TypeAAAA,
-						Class:  dns.ClassINET,
-						Ttl:    record.TTL,
-					},
-					AAAA: net.ParseIP(record.Value),
-				})
-			}
-
-		case dns.TypeCNAME:
-			if record.Type == "CNAME" {
-				msg.Answer = append(msg.Answer, &dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:   question.Name,
-						Rrtype: dns.TypeCNAME,
-						Class:  dns.ClassINET,
-						Ttl:    record.TTL,
-					},
-					Target: dns.Fqdn(record.Value),
-				})
-			}
-
-		case dns.TypeMX:
-			if record.Type == "MX" {
-				msg.Answer = append(msg.Answer, &dns.MX{
-					Hdr: dns.RR_Header{
-						Name:   question.Name,
-						Rrtype: dns.TypeMX,
-						Class:  dns.ClassINET,
-						Ttl:    record.TTL,
-					},
-					Preference: record.Priority,
-					Mx:         dns.Fqdn(record.Value),
-				})
-			}
-
-		case dns.TypeTXT:
-			if record.Type == "TXT" {
-				msg.Answer = append(msg.Answer, &dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:   question.Name,
-						Rrtype: dns.TypeTXT,
-						Class:  dns.ClassINET,
-						Ttl:    record.TTL,
-					},
-					Txt: []string{record.Value},
-				})
-			}
+		if rr := recordRR(question.Name, record); rr != nil {
+			msg.Answer = append(msg.Answer, rr)
 		}
 	}
 
 	if len(msg.Answer) == 0 {
-		atomic.AddUint64(&s.stats.NXDomain, 1)
 		msg.Rcode = dns.RcodeNameError
 	}
 
-	if err := w.WriteMsg(msg); err != nil {
-		log.Printf("[DNS] Error writing response: %v", err)
-	}
+	return msg
 }
 
-func (s *DNSServer) sendNXDOMAIN(w dns.ResponseWriter, r *dns.Msg) {
+func nxdomainResponse(r *dns.Msg) *dns.Msg {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Rcode = dns.RcodeNameError
-	if err := w.WriteMsg(msg); err != nil {
-		log.Printf("[DNS] Error writing NXDOMAIN response: %v", err)
-	}
+	return msg
 }
 
 func cleanDomain(domain string) string {
@@ -300,6 +516,20 @@ func extractParentDomain(domain string) string {
 	return strings.Join(parts[len(parts)-2:], ".")
 }
 
+// zoneOf returns the configured zone a name belongs to, using the same
+// two-label heuristic as the domain lookup.
+func zoneOf(domain string) string {
+	if parent := extractParentDomain(domain); parent != "" {
+		return parent
+	}
+	return domain
+}
+
+func isUDP(addr net.Addr) bool {
+	_, ok := addr.(*net.UDPAddr)
+	return ok
+}
+
 func extractClientIP(addr net.Addr) string {
 	switch v := addr.(type) {
 	case *net.UDPAddr:
@@ -311,79 +541,19 @@ func extractClientIP(addr net.Addr) string {
 	}
 }
 
-func findBestAgentIP(geoDNSMap map[string]string, clientLocation string) string {
-	// Try exact match first
-	if ip, ok := geoDNSMap[clientLocation]; ok {
-		return ip
-	}
-
-	// Try fallback locations
-	fallbackMap := map[string][]string{
-		"us": {"ca", "mx", "gb", "de"},
-		"ca": {"us", "mx", "gb", "de"},
-		"mx": {"us", "ca", "br", "cl"},
-		"br": {"ar", "cl", "us", "mx"},
-		"ar": {"br", "cl", "mx", "us"},
-		"cl": {"ar", "br", "mx", "us"},
-		"co": {"br", "ar", "mx", "cl"},
-		"gb": {"de", "fr", "nl", "us"},
-		"de": {"nl", "fr", "gb", "pl"},
-		"fr": {"de", "gb", "es", "it"},
-		"it": {"fr", "de", "es", "tr"},
-		"es": {"fr", "it", "br", "mx"},
-		"nl": {"de", "gb", "fr", "pl"},
-		"pl": {"de", "ua", "ru", "nl"},
-		"ua": {"pl", "ru", "tr", "de"},
-		"ru": {"ua", "pl", "kz", "cn"},
-		"cn": {"jp", "kr", "sg", "in"},
-		"jp": {"kr", "cn", "sg", "au"},
-		"kr": {"jp", "cn", "sg", "au"},
-		"in": {"sg", "th", "id", "ae"},
-		"id": {"sg", "th", "au", "in"},
-		"th": {"sg", "id", "in", "cn"},
-		"sg": {"id", "th", "in", "au"},
-		"au": {"nz", "sg", "id", "jp"},
-		"nz": {"au", "sg", "id", "jp"},
-		"za": {"eg", "ng", "ae", "gb"},
-		"eg": {"ae", "tr", "za", "ng"},
-		"ng": {"za", "eg", "br", "fr"},
-		"ae": {"ir", "tr", "in", "eg"},
-		"tr": {"ae", "ir", "eg", "it"},
-		"ir": {"ae", "tr", "kz", "in"},
-		"kz": {"ru", "cn", "ir", "tr"},
-	}
-
-	if fallbacks, ok := fallbackMap[clientLocation]; ok {
-		for _, fallback := range fallbacks {
-			if ip, ok := geoDNSMap[fallback]; ok {
-				log.Printf("[GeoDNS] No exact match for '%s', using fallback '%s' -> %s", clientLocation, fallback, ip)
-				return ip
-			}
-		}
-	}
-
-	// Use default if available
-	if ip, ok := geoDNSMap["default"]; ok {
-		log.Printf("[GeoDNS] No match for '%s', using default -> %s", clientLocation, ip)
-		return ip
-	}
-
-	// Return any available IP as last resort
-	for location, ip := range geoDNSMap {
-		log.Printf("[GeoDNS] No default available, using any available location '%s' -> %s", location, ip)
-		return ip
-	}
-
-	log.Printf("[GeoDNS] No agent IPs available in GeoDNS map")
-	return ""
-}
-
 func (s *DNSServer) GetStats() DNSStats {
 	return DNSStats{
-		TotalQueries:  atomic.LoadUint64(&s.stats.TotalQueries),
-		CacheHits:     atomic.LoadUint64(&s.stats.CacheHits),
-		CacheMisses:   atomic.LoadUint64(&s.stats.CacheMisses),
-		GeoDNSQueries: atomic.LoadUint64(&s.stats.GeoDNSQueries),
-		NXDomain:      atomic.LoadUint64(&s.stats.NXDomain),
+		TotalQueries:    atomic.LoadUint64(&s.stats.TotalQueries),
+		CacheHits:       atomic.LoadUint64(&s.stats.CacheHits),
+		CacheMisses:     atomic.LoadUint64(&s.stats.CacheMisses),
+		GeoDNSQueries:   atomic.LoadUint64(&s.stats.GeoDNSQueries),
+		NXDomain:        atomic.LoadUint64(&s.stats.NXDomain),
+		QueryLogDropped: atomic.LoadUint64(&s.stats.QueryLogDropped),
+		RRLDropped:      atomic.LoadUint64(&s.stats.RRLDropped),
+		RRLSlipped:      atomic.LoadUint64(&s.stats.RRLSlipped),
+		QTypeLimited:    atomic.LoadUint64(&s.stats.QTypeLimited),
+		ANYTruncated:    atomic.LoadUint64(&s.stats.ANYTruncated),
+		Truncated:       atomic.LoadUint64(&s.stats.Truncated),
+		Rejected:        atomic.LoadUint64(&s.stats.Rejected),
 	}
 }
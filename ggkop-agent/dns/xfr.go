@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TransferConfig controls zone transfers to secondary servers. Transfers are
+// refused unless at least one of AllowFrom and TSIGKeys is set; when both
+// are set a client must match both.
+type TransferConfig struct {
+	AllowFrom []netip.Prefix    // client networks allowed to transfer
+	TSIGKeys  map[string]string // key name (FQDN) -> base64 secret
+	Notify    []string          // secondaries to NOTIFY on zone changes (host or host:port)
+	NotifyKey string            // TSIG key name used to sign NOTIFY messages
+}
+
+// transferChunk is the number of records sent per message of a transfer.
+const transferChunk = 256
+
+// ParseTSIGKeys parses "name:secret,name2:secret2" with base64 secrets.
+func ParseTSIGKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(part, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid TSIG key %q, want name:secret", part)
+		}
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return nil, fmt.Errorf("TSIG key %s: secret is not base64: %w", name, err)
+		}
+		keys[dns.CanonicalName(name)] = secret
+	}
+	return keys, nil
+}
+
+// ParsePrefixes parses a comma-separated list of CIDRs or bare IPs.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, err := parseOverridePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// handleTransfer answers AXFR and IXFR queries from the zone store.
+func (s *DNSServer) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
+	zone := cleanDomain(question.Name)
+	client := extractClientIP(w.RemoteAddr())
+
+	if !s.transferAllowed(w, r, client) {
+		log.Printf("[DNS] Refused %s of %s to %s", dns.TypeToString[question.Qtype], zone, client)
+		s.writeSignedReply(w, r, dns.RcodeRefused)
+		return
+	}
+
+	var rrs []dns.RR
+	var ok bool
+	if question.Qtype == dns.TypeIXFR {
+		serial, hasSerial := ixfrSerial(r)
+		if !hasSerial {
+			s.writeSignedReply(w, r, dns.RcodeFormatError)
+			return
+		}
+		rrs, ok = s.zones.IXFR(zone, serial)
+		if ok && isUDP(w.RemoteAddr()) {
+			// Answer with just the SOA; the client retries over TCP when it
+			// is behind (RFC 1995 section 2)
+			rrs = rrs[:1]
+		}
+	} else {
+		if isUDP(w.RemoteAddr()) {
+			s.writeSignedReply(w, r, dns.RcodeRefused)
+			return
+		}
+		rrs, ok = s.zones.AXFR(zone)
+	}
+
+	if !ok {
+		s.writeSignedReply(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tr.Out(w, r, ch)
+	}()
+
+	// tr.Out stops reading ch when a write fails, e.g. the client went away
+	var err error
+	sent := true
+	for sent && len(rrs) > 0 {
+		n := min(len(rrs), transferChunk)
+		select {
+		case ch <- &dns.Envelope{RR: rrs[:n]}:
+			rrs = rrs[n:]
+		case err = <-errc:
+			sent = false
+		}
+	}
+	close(ch)
+	if sent {
+		err = <-errc
+	}
+
+	if err != nil {
+		log.Printf("[DNS] Error sending %s of %s to %s: %v", dns.TypeToString[question.Qtype], zone, client, err)
+		return
+	}
+	log.Printf("[DNS] Sent %s of %s to %s", dns.TypeToString[question.Qtype], zone, client)
+}
+
+func (s *DNSServer) transferAllowed(w dns.ResponseWriter, r *dns.Msg, client string) bool {
+	if len(s.transfer.AllowFrom) == 0 && len(s.transfer.TSIGKeys) == 0 {
+		return false
+	}
+	// A TSIG we hold no keys for cannot be verified
+	if r.IsTsig() != nil && len(s.transfer.TSIGKeys) == 0 {
+		return false
+	}
+
+	if len(s.transfer.AllowFrom) > 0 {
+		addr, err := netip.ParseAddr(client)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+
+		allowed := false
+		for _, prefix := range s.transfer.AllowFrom {
+			if prefix.Contains(addr) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(s.transfer.TSIGKeys) > 0 {
+		return r.IsTsig() != nil && w.TsigStatus() == nil
+	}
+	return true
+}
+
+// writeSignedReply sends an empty reply with rcode, TSIG-signed when the
+// request was signed with one of our keys.
+func (s *DNSServer) writeSignedReply(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	msg := new(dns.Msg)
+	msg.SetRcode(r, rcode)
+	if tsig := r.IsTsig(); tsig != nil && len(s.transfer.TSIGKeys) > 0 && w.TsigStatus() == nil {
+		msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	if err := w.WriteMsg(msg); err != nil {
+		log.Printf("[DNS] Error writing response: %v", err)
+	}
+}
+
+// handleNotify acknowledges a NOTIFY for a secondary zone and schedules an
+// immediate refresh.
+func (s *DNSServer) handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	zone := cleanDomain(r.Question[0].Name)
+	client := extractClientIP(w.RemoteAddr())
+
+	if !s.secondaries.HandleNotify(w, r) {
+		log.Printf("[DNS] Refused NOTIFY for %s from %s", zone, client)
+		s.writeSignedReply(w, r, dns.RcodeRefused)
+		return
+	}
+
+	log.Printf("[DNS] NOTIFY for %s from %s, refreshing", zone, client)
+	s.writeSignedReply(w, r, dns.RcodeSuccess)
+}
+
+// ixfrSerial returns the client's current serial from the SOA in the
+// authority section of an IXFR query.
+func ixfrSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// notifySecondaries sends NOTIFY for each changed zone to every configured
+// secondary. It runs in the background and retries lost messages.
+func (s *DNSServer) notifySecondaries(zones []string) {
+	if len(s.transfer.Notify) == 0 {
+		return
+	}
+
+	for _, zone := range zones {
+		soa := s.zones.SOA(zone)
+		if soa == nil {
+			continue
+		}
+		for _, target := range s.transfer.Notify {
+			go func(zone string, soa *dns.SOA, target string) {
+				if err := s.sendNotify(zone, soa, target); err != nil {
+					log.Printf("[DNS] NOTIFY for %s to %s failed: %v", zone, target, err)
+				}
+			}(zone, soa, target)
+		}
+	}
+}
+
+func (s *DNSServer) sendNotify(zone string, soa *dns.SOA, target string) error {
+	target = withDefaultPort(target)
+
+	msg := new(dns.Msg)
+	msg.SetNotify(dns.Fqdn(zone))
+	msg.Answer = []dns.RR{soa}
+
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	if key := dns.CanonicalName(s.transfer.NotifyKey); s.transfer.NotifyKey != "" {
+		secret, ok := s.transfer.TSIGKeys[key]
+		if !ok {
+			return fmt.Errorf("unknown TSIG key %s", s.transfer.NotifyKey)
+		}
+		client.TsigSecret = map[string]string{key: secret}
+		msg.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(msg, target)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("secondary answered %s", dns.RcodeToString[resp.Rcode])
+		}
+		return nil
+	}
+	return err
+}
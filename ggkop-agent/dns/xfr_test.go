@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ggkop/agent/config"
+	"github.com/miekg/dns"
+)
+
+func testDomain(ip string) config.Domain {
+	return config.Domain{
+		Domain: "example.com",
+		DNSRecords: []config.DNSRecord{
+			{Name: "@", Type: "A", Value: ip, TTL: 300},
+			{Name: "@", Type: "NS", Value: "ns1.example.net", TTL: 3600},
+			{Name: "www", Type: "CNAME", Value: "example.com", TTL: 300},
+		},
+	}
+}
+
+func TestZoneStore_SerialAndIXFR(t *testing.T) {
+	zones := NewZoneStore()
+
+	if changed := zones.Update([]config.Domain{testDomain("192.0.2.1")}); len(changed) != 1 {
+		t.Fatalf("first Update changed = %v, want [example.com]", changed)
+	}
+	first := zones.SOA("example.com").Serial
+
+	if changed := zones.Update([]config.Domain{testDomain("192.0.2.1")}); len(changed) != 0 {
+		t.Errorf("identical Update changed = %v, want none", changed)
+	}
+
+	zones.Update([]config.Domain{testDomain("192.0.2.2")})
+	soa := zones.SOA("example.com")
+	if soa.Serial == first {
+		t.Fatalf("serial %d unchanged after change", soa.Serial)
+	}
+
+	// Another agent with the same configuration agrees on the serial
+	other := NewZoneStore()
+	other.Update([]config.Domain{testDomain("192.0.2.2")})
+	if serial := other.SOA("example.com").Serial; serial != soa.Serial {
+		t.Errorf("serial = %d on a fresh store, want %d", serial, soa.Serial)
+	}
+	if soa.Ns != "ns1.example.net." {
+		t.Errorf("SOA primary = %s, want the apex NS", soa.Ns)
+	}
+
+	rrs, ok := zones.IXFR("example.com", first)
+	if !ok {
+		t.Fatal("IXFR: zone not found")
+	}
+	// new SOA, old SOA, deleted A, new SOA, added A, new SOA
+	if len(rrs) != 6 {
+		t.Fatalf("IXFR returned %d records, want 6:\n%v", len(rrs), rrs)
+	}
+	if rrs[1].(*dns.SOA).Serial != first || rrs[2].(*dns.A).A.String() != "192.0.2.1" || rrs[4].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("unexpected IXFR sequence:\n%v", rrs)
+	}
+
+	if rrs, _ := zones.IXFR("example.com", soa.Serial); len(rrs) != 1 {
+		t.Errorf("up-to-date IXFR returned %d records, want just the SOA", len(rrs))
+	}
+}
+
+func TestTransfer_AXFRWithTSIG(t *testing.T) {
+	const keyName = "xfr-key."
+	const secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+	server := &DNSServer{
+		stats: &DNSStats{},
+		zones: NewZoneStore(),
+		transfer: TransferConfig{
+			AllowFrom: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			TSIGKeys:  map[string]string{keyName: secret},
+		},
+	}
+	server.zones.Update([]config.Domain{testDomain("192.0.2.1")})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener:   listener,
+		Handler:    dns.HandlerFunc(server.handleDNSRequest),
+		TsigSecret: server.transfer.TSIGKeys,
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	transfer := func(withKey bool) ([]dns.RR, error) {
+		msg := new(dns.Msg)
+		msg.SetAxfr("example.com.")
+		tr := new(dns.Transfer)
+		if withKey {
+			msg.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+			tr.TsigSecret = map[string]string{keyName: secret}
+		}
+		envelopes, err := tr.In(msg, listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		var rrs []dns.RR
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			rrs = append(rrs, envelope.RR...)
+		}
+		return rrs, nil
+	}
+
+	rrs, err := transfer(true)
+	if err != nil {
+		t.Fatalf("signed AXFR failed: %v", err)
+	}
+	// SOA, 3 records, SOA
+	if len(rrs) != 5 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[4].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("AXFR returned:\n%v", rrs)
+	}
+
+	if _, err := transfer(false); err == nil {
+		t.Error("unsigned AXFR succeeded, want refusal")
+	}
+}
+
+func TestTransfer_ClientGoneMidTransfer(t *testing.T) {
+	server := &DNSServer{
+		stats: &DNSStats{},
+		zones: NewZoneStore(),
+		transfer: TransferConfig{
+			AllowFrom: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		},
+	}
+	domain := testDomain("192.0.2.1")
+	value := strings.Repeat("x", 200)
+	for i := 0; i < 20000; i++ {
+		domain.DNSRecords = append(domain.DNSRecords, config.DNSRecord{
+			Name: fmt.Sprintf("host%d", i), Type: "TXT", Value: value, TTL: 300,
+		})
+	}
+	server.zones.Update([]config.Domain{domain})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	srv := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			server.handleDNSRequest(w, r)
+			close(done)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	conn, err := dns.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetAxfr("example.com.")
+	if err := conn.WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer handler still blocked after the client went away")
+	}
+}
@@ -0,0 +1,286 @@
+package dns
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ggkop/agent/config"
+	"github.com/miekg/dns"
+)
+
+// SOA timers for zones built from the Core configuration.
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 604800
+	soaMinTTL  = uint32(negativeCacheTTL / time.Second)
+	soaTTL     = 3600
+
+	// zoneHistory is how many previous versions of a zone are kept to answer
+	// IXFR with a diff instead of a full transfer.
+	zoneHistory = 16
+)
+
+// zoneVersion is an immutable snapshot of one zone's records (SOA excluded).
+type zoneVersion struct {
+	serial  uint32
+	hash    uint64
+	records []dns.RR
+}
+
+// ZoneStore turns the Core configuration into versioned zones for zone
+// transfers. A zone's serial is derived from its records, so every agent
+// serving the same configuration hands out the same serial. Serials change
+// with the records but are not ordered.
+type ZoneStore struct {
+	mu    sync.RWMutex
+	zones map[string]*zoneVersions
+}
+
+type zoneVersions struct {
+	name    string
+	soa     *dns.SOA
+	current *zoneVersion
+	history []*zoneVersion // oldest first
+}
+
+func NewZoneStore() *ZoneStore {
+	return &ZoneStore{zones: make(map[string]*zoneVersions)}
+}
+
+// Update rebuilds every zone from domains and returns the names of zones that
+// are new or whose records changed. Zones missing from domains are dropped.
+func (z *ZoneStore) Update(domains []config.Domain) []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var changed []string
+	seen := make(map[string]bool, len(domains))
+
+	for i := range domains {
+		domain := &domains[i]
+		name := strings.ToLower(domain.Domain)
+		seen[name] = true
+
+		records := zoneRecords(domain)
+		hash := hashRecords(records)
+
+		zone, ok := z.zones[name]
+		if ok && zone.current.hash == hash {
+			continue
+		}
+
+		serial := uint32(hash>>32) ^ uint32(hash)
+		if ok {
+			zone.history = append(zone.history, zone.current)
+			if len(zone.history) > zoneHistory {
+				zone.history = zone.history[len(zone.history)-zoneHistory:]
+			}
+		} else {
+			zone = &zoneVersions{name: name}
+			z.zones[name] = zone
+		}
+
+		zone.current = &zoneVersion{serial: serial, hash: hash, records: records}
+		zone.soa = zoneSOA(name, records, serial)
+		changed = append(changed, name)
+	}
+
+	for name := range z.zones {
+		if !seen[name] {
+			delete(z.zones, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// SOA returns the current SOA record of zone, or nil if it is not served.
+func (z *ZoneStore) SOA(zone string) *dns.SOA {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if versions, ok := z.zones[strings.ToLower(zone)]; ok {
+		return versions.soa
+	}
+	return nil
+}
+
+// AXFR returns the full zone framed by its SOA record.
+func (z *ZoneStore) AXFR(zone string) ([]dns.RR, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	versions, ok := z.zones[strings.ToLower(zone)]
+	if !ok {
+		return nil, false
+	}
+	return versions.axfr(), true
+}
+
+// IXFR returns the changes since serial as a single condensed difference
+// sequence (RFC 1995). A client that is up to date gets just the SOA; a
+// serial older than the kept history gets a full AXFR-style answer.
+func (z *ZoneStore) IXFR(zone string, serial uint32) ([]dns.RR, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	versions, ok := z.zones[strings.ToLower(zone)]
+	if !ok {
+		return nil, false
+	}
+
+	if serial == versions.current.serial {
+		return []dns.RR{versions.soa}, true
+	}
+
+	for _, old := range versions.history {
+		if old.serial != serial {
+			continue
+		}
+
+		oldSOA := dns.Copy(versions.soa).(*dns.SOA)
+		oldSOA.Serial = old.serial
+
+		deleted, added := diffRecords(old.records, versions.current.records)
+
+		rrs := make([]dns.RR, 0, len(deleted)+len(added)+4)
+		rrs = append(rrs, versions.soa, oldSOA)
+		rrs = append(rrs, deleted...)
+		rrs = append(rrs, versions.soa)
+		rrs = append(rrs, added...)
+		rrs = append(rrs, versions.soa)
+		return rrs, true
+	}
+
+	return versions.axfr(), true
+}
+
+func (v *zoneVersions) axfr() []dns.RR {
+	rrs := make([]dns.RR, 0, len(v.current.records)+2)
+	rrs = append(rrs, v.soa)
+	rrs = append(rrs, v.current.records...)
+	rrs = append(rrs, v.soa)
+	return rrs
+}
+
+// zoneRecords converts the domain's records to RRs in a stable order. GeoDNS
+// location records are not part of the zone; the apex default A record is.
+func zoneRecords(domain *config.Domain) []dns.RR {
+	var records []dns.RR
+	for _, record := range domain.DNSRecords {
+		owner := dns.Fqdn(recordOwner(record, domain.Domain))
+		if rr := recordRR(owner, record); rr != nil {
+			records = append(records, rr)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].String() < records[j].String()
+	})
+	return records
+}
+
+func zoneSOA(zone string, records []dns.RR, serial uint32) *dns.SOA {
+	origin := dns.Fqdn(zone)
+
+	// The first apex NS record is the primary; fall back to ns1.<zone>
+	primary := "ns1." + origin
+	for _, rr := range records {
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == origin {
+			primary = ns.Ns
+			break
+		}
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:      primary,
+		Mbox:    "hostmaster." + origin,
+		Serial:  serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  soaMinTTL,
+	}
+}
+
+func hashRecords(records []dns.RR) uint64 {
+	h := fnv.New64a()
+	for _, rr := range records {
+		h.Write([]byte(rr.String()))
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum64()
+}
+
+func diffRecords(old, current []dns.RR) (deleted, added []dns.RR) {
+	oldSet := make(map[string]bool, len(old))
+	for _, rr := range old {
+		oldSet[rr.String()] = true
+	}
+	currentSet := make(map[string]bool, len(current))
+	for _, rr := range current {
+		currentSet[rr.String()] = true
+		if !oldSet[rr.String()] {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range old {
+		if !currentSet[rr.String()] {
+			deleted = append(deleted, rr)
+		}
+	}
+	return deleted, added
+}
+
+// recordOwner returns the name a configured record answers for ("@" is the
+// zone apex, relative names are qualified with the zone).
+func recordOwner(record config.DNSRecord, zone string) string {
+	name := record.Name
+	if name == "@" {
+		return zone
+	}
+	if !strings.HasSuffix(name, ".") {
+		return name + "." + zone
+	}
+	return name
+}
+
+// recordRR converts a configured record to an RR owned by name. It returns
+// nil for unsupported types and unparseable values.
+func recordRR(name string, record config.DNSRecord) dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: record.TTL}
+	}
+
+	switch record.Type {
+	case "A":
+		ip := net.ParseIP(record.Value).To4()
+		if ip == nil {
+			return nil
+		}
+		return &dns.A{Hdr: hdr(dns.TypeA), A: ip}
+	case "AAAA":
+		ip := net.ParseIP(record.Value)
+		if ip == nil {
+			return nil
+		}
+		return &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip}
+	case "CNAME":
+		return &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: dns.Fqdn(record.Value)}
+	case "MX":
+		return &dns.MX{Hdr: hdr(dns.TypeMX), Preference: record.Priority, Mx: dns.Fqdn(record.Value)}
+	case "TXT":
+		return &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{record.Value}}
+	case "NS":
+		return &dns.NS{Hdr: hdr(dns.TypeNS), Ns: dns.Fqdn(record.Value)}
+	default:
+		return nil
+	}
+}
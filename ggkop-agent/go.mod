@@ -1,17 +1,25 @@
 module github.com/ggkop/agent
 
-go 1.21
+go 1.24
 
 require (
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/miekg/dns v1.1.55
 	github.com/oschwald/geoip2-golang v1.9.0
+	github.com/quic-go/quic-go v0.59.1
 	github.com/yuin/gopher-lua v1.1.0
+	golang.org/x/crypto v0.41.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
+	github.com/farsightsec/golang-framestream v0.3.0 // indirect
 	github.com/oschwald/maxminddb-golang v1.11.0 // indirect
-	golang.org/x/mod v0.7.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/tools v0.3.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
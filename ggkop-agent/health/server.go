@@ -1,9 +1,12 @@
 package health
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"runtime"
 	"time"
@@ -12,8 +15,9 @@ import (
 )
 
 type HealthServer struct {
-	configMgr *config.ConfigManager
-	startTime time.Time
+	configMgr  *config.ConfigManager
+	startTime  time.Time
+	httpServer *http.Server
 }
 
 type HealthResponse struct {
@@ -27,8 +31,9 @@ type HealthResponse struct {
 }
 
 type StatsResponse struct {
-	Config  ConfigStats  `json:"config"`
-	Runtime RuntimeStats `json:"runtime"`
+	Config       ConfigStats              `json:"config"`
+	Certificates []config.CertificateInfo `json:"certificates"`
+	Runtime      RuntimeStats             `json:"runtime"`
 }
 
 type ConfigStats struct {
@@ -47,19 +52,38 @@ type RuntimeStats struct {
 	NumCPU       int    `json:"num_cpu"`
 }
 
-func StartHealthCheck(configMgr *config.ConfigManager) {
+// StartHealthCheck binds addr and serves /health and /stats in the
+// background.
+func StartHealthCheck(configMgr *config.ConfigManager, addr string) (*HealthServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("health check: %w", err)
+	}
+
 	server := &HealthServer{
 		configMgr: configMgr,
 		startTime: time.Now(),
 	}
 
-	http.HandleFunc("/health", server.handleHealth)
-	http.HandleFunc("/stats", server.handleStats)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", server.handleHealth)
+	mux.HandleFunc("/stats", server.handleStats)
+	server.httpServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
 
-	log.Println("[Health] Starting health check server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Printf("[Health] Failed to start server: %v", err)
-	}
+	go func() {
+		log.Printf("[Health] Starting health check server on %s", listener.Addr())
+		if err := server.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[Health] Server stopped: %v", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// Shutdown stops the health check server, waiting for in-flight requests
+// until ctx expires.
+func (h *HealthServer) Shutdown(ctx context.Context) error {
+	return h.httpServer.Shutdown(ctx)
 }
 
 func (h *HealthServer) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -95,6 +119,7 @@ func (h *HealthServer) handleStats(w http.ResponseWriter, r *http.Request) {
 			DomainsLoaded: stats.DomainsLoaded,
 			ProxiesActive: stats.ProxiesActive,
 		},
+		Certificates: h.configMgr.Certificates(),
 		Runtime: RuntimeStats{
 			Uptime:       formatDuration(time.Since(h.startTime)),
 			MemoryAlloc:  formatBytes(m.Alloc),
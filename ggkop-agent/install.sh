@@ -15,7 +15,7 @@ SERVICE_FILE="/etc/systemd/system/defenra-agent.service"
 GEOIP_URL="https://github.com/P3TERX/GeoLite.mmdb/raw/download/GeoLite2-City.mmdb"
 GITHUB_REPO="Defenra/DefenraAgent"
 GITHUB_API="https://api.github.com/repos/${GITHUB_REPO}/releases/latest"
-MIN_GO_VERSION="1.21"
+MIN_GO_VERSION="1.24"
 
 # Helper functions
 print_header() {
@@ -61,8 +61,8 @@ check_go() {
         echo "Visit: https://golang.org/dl/"
         echo ""
         echo "Quick install (Linux):"
-        echo "  wget https://go.dev/dl/go1.21.0.linux-amd64.tar.gz"
-        echo "  sudo tar -C /usr/local -xzf go1.21.0.linux-amd64.tar.gz"
+        echo "  wget https://go.dev/dl/go1.24.0.linux-amd64.tar.gz"
+        echo "  sudo tar -C /usr/local -xzf go1.24.0.linux-amd64.tar.gz"
         echo "  export PATH=\$PATH:/usr/local/go/bin"
         exit 1
     fi
@@ -468,8 +468,8 @@ build_agent() {
         echo "Visit: https://golang.org/dl/"
         echo ""
         echo "Quick install (Linux):"
-        echo "  wget https://go.dev/dl/go1.21.0.linux-amd64.tar.gz"
-        echo "  sudo tar -C /usr/local -xzf go1.21.0.linux-amd64.tar.gz"
+        echo "  wget https://go.dev/dl/go1.24.0.linux-amd64.tar.gz"
+        echo "  sudo tar -C /usr/local -xzf go1.24.0.linux-amd64.tar.gz"
         echo "  export PATH=\$PATH:/usr/local/go/bin"
         exit 1
     fi
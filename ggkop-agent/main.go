@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/ggkop/agent/acme"
 	"github.com/ggkop/agent/config"
 	"github.com/ggkop/agent/dns"
 	"github.com/ggkop/agent/health"
@@ -30,30 +39,247 @@ func main() {
 	log.Printf("Polling Interval: %d seconds", pollingInterval)
 
 	configMgr := config.NewConfigManager(coreURL, agentID, agentKey)
+	configMgr.SetDefaultCertificate(getEnvString("TLS_DEFAULT_DOMAIN", ""))
 
 	go configMgr.StartPolling(time.Duration(pollingInterval) * time.Second)
 
 	log.Println("Waiting for initial configuration...")
 	time.Sleep(2 * time.Second)
 
-	log.Println("Starting DNS Server on :53...")
-	go dns.StartDNSServer(configMgr)
+	dnsConfig := dns.Config{
+		GeoIP:     dns.DefaultGeoIPConfig(),
+		CacheSize: getEnvInt("CACHE_SIZE", 10000),
+		QueryLog: dns.QueryLogConfig{
+			Output:       getEnvString("DNS_QUERY_LOG", ""),
+			SampleEvery:  getEnvInt("DNS_QUERY_LOG_SAMPLE", 1),
+			DnstapSocket: getEnvString("DNSTAP_SOCKET", ""),
+			DnstapFile:   getEnvString("DNSTAP_FILE", ""),
+			Identity:     agentID,
+		},
+	}
+	dnsConfig.GeoIP.CityDBPath = getEnvString("GEOIP_DB_PATH", dnsConfig.GeoIP.CityDBPath)
+	dnsConfig.GeoIP.ASNDBPath = getEnvString("GEOIP_ASN_DB_PATH", dnsConfig.GeoIP.ASNDBPath)
+	dnsConfig.GeoIP.CacheSize = getEnvInt("GEOIP_CACHE_SIZE", dnsConfig.GeoIP.CacheSize)
+	dnsConfig.GeoIP.CacheTTL = getEnvSeconds("GEOIP_CACHE_TTL", dnsConfig.GeoIP.CacheTTL)
+	dnsConfig.GeoIP.ReloadInterval = getEnvSeconds("GEOIP_RELOAD_INTERVAL", dnsConfig.GeoIP.ReloadInterval)
+	dnsConfig.GeoIP.OverridesFile = getEnvString("GEOIP_OVERRIDES_FILE", "")
+
+	dnsConfig.UDPSize = uint16(getEnvInt("DNS_EDNS_UDP_SIZE", dns.DefaultUDPSize))
+	dnsConfig.NSID = getEnvString("DNS_NSID", "")
+
+	xfrAllow, err := dns.ParsePrefixes(getEnvString("DNS_XFR_ALLOW", ""))
+	if err != nil {
+		log.Fatalf("Invalid DNS_XFR_ALLOW: %v", err)
+	}
+	tsigKeys, err := dns.ParseTSIGKeys(getEnvString("DNS_TSIG_KEYS", ""))
+	if err != nil {
+		log.Fatalf("Invalid DNS_TSIG_KEYS: %v", err)
+	}
+	dnsConfig.Transfer = dns.TransferConfig{
+		AllowFrom: xfrAllow,
+		TSIGKeys:  tsigKeys,
+		Notify:    splitList(getEnvString("DNS_NOTIFY", "")),
+		NotifyKey: getEnvString("DNS_NOTIFY_TSIG_KEY", ""),
+	}
+
+	dnsConfig.Secondary, err = dns.ParseSecondaryZones(getEnvString("DNS_SECONDARY_ZONES", ""), getEnvString("DNS_SECONDARY_TSIG_KEY", ""))
+	if err != nil {
+		log.Fatalf("Invalid DNS_SECONDARY_ZONES: %v", err)
+	}
+
+	dnsConfig.RRL = dns.DefaultRRLConfig()
+	dnsConfig.RRL.Enabled = getEnvBool("DNS_RRL_ENABLED", dnsConfig.RRL.Enabled)
+	dnsConfig.RRL.ResponsesPerSecond = getEnvInt("DNS_RRL_RESPONSES_PER_SECOND", dnsConfig.RRL.ResponsesPerSecond)
+	dnsConfig.RRL.NXDomainsPerSecond = getEnvInt("DNS_RRL_NXDOMAINS_PER_SECOND", dnsConfig.RRL.NXDomainsPerSecond)
+	dnsConfig.RRL.ErrorsPerSecond = getEnvInt("DNS_RRL_ERRORS_PER_SECOND", dnsConfig.RRL.ErrorsPerSecond)
+	dnsConfig.RRL.Window = getEnvInt("DNS_RRL_WINDOW", dnsConfig.RRL.Window)
+	dnsConfig.RRL.Slip = getEnvInt("DNS_RRL_SLIP", dnsConfig.RRL.Slip)
+	dnsConfig.RRL.IPv4PrefixLen = getEnvInt("DNS_RRL_IPV4_PREFIX", dnsConfig.RRL.IPv4PrefixLen)
+	dnsConfig.RRL.IPv6PrefixLen = getEnvInt("DNS_RRL_IPV6_PREFIX", dnsConfig.RRL.IPv6PrefixLen)
+	dnsConfig.RRL.TruncateANY = getEnvBool("DNS_TRUNCATE_ANY", dnsConfig.RRL.TruncateANY)
+	dnsConfig.RRL.QTypeLimits = dns.ParseQTypeLimits(getEnvString("DNS_RRL_QTYPE_LIMITS", ""))
 
-	log.Println("Starting HTTP Proxy on :80...")
-	go proxy.StartHTTPProxy(configMgr)
+	dnsConfig.DoT = getEnvBool("DNS_DOT_ENABLED", false)
+	dnsConfig.TLSDomain = getEnvString("DNS_TLS_DOMAIN", "")
+
+	var dohHost string
+	if getEnvBool("DNS_DOH_ENABLED", false) {
+		dohHost = strings.ToLower(getEnvString("DNS_DOH_HOST", ""))
+		if dohHost == "" {
+			log.Fatal("DNS_DOH_ENABLED requires DNS_DOH_HOST")
+		}
+	}
+
+	dnsConfig.ListenAddrs = listenAddrs("DNS_LISTEN", "53")
+	dnsConfig.DoTAddrs = listenAddrs("DNS_DOT_LISTEN", "853")
+
+	var services []service
+	startupFailed := func(name string, err error) {
+		log.Printf("Failed to start %s: %v", name, err)
+		shutdown(services, getEnvSeconds("SHUTDOWN_TIMEOUT", 30*time.Second))
+		os.Exit(1)
+	}
 
-	log.Println("Starting HTTPS Proxy on :443...")
-	go proxy.StartHTTPSProxy(configMgr)
+	log.Printf("Starting DNS Server on %s...", strings.Join(dnsConfig.ListenAddrs, ", "))
+	dnsServer, err := dns.StartDNSServer(configMgr, dnsConfig)
+	if err != nil {
+		startupFailed("DNS server", err)
+	}
+	services = append(services, service{"DNS server", dnsServer.Shutdown})
+
+	var doh http.Handler
+	if dohHost != "" {
+		doh = dnsServer
+	}
+
+	var acmeMgr *acme.Manager
+	if getEnvBool("ACME_ENABLED", false) {
+		acmeConfig := acme.DefaultConfig()
+		acmeConfig.DirectoryURL = getEnvString("ACME_DIRECTORY_URL", acmeConfig.DirectoryURL)
+		acmeConfig.Email = getEnvString("ACME_EMAIL", "")
+		acmeConfig.StorageDir = getEnvString("ACME_STORAGE_DIR", acmeConfig.StorageDir)
+		acmeConfig.CACertFile = getEnvString("ACME_CA_CERT", "")
+		if challenges := splitList(getEnvString("ACME_CHALLENGES", "")); len(challenges) > 0 {
+			acmeConfig.Challenges = challenges
+		}
+		acmeConfig.RenewBefore = time.Duration(getEnvInt("ACME_RENEW_BEFORE_DAYS", int(acmeConfig.RenewBefore/(24*time.Hour)))) * 24 * time.Hour
+		acmeConfig.CheckInterval = getEnvSeconds("ACME_CHECK_INTERVAL", acmeConfig.CheckInterval)
+		acmeConfig.Coordination = getEnvString("ACME_COORDINATION", acmeConfig.Coordination)
+		acmeConfig.PropagationWait = time.Duration(pollingInterval) * time.Second
+
+		acmeMgr, err = acme.NewManager(configMgr, acmeConfig)
+		if err != nil {
+			startupFailed("ACME client", err)
+		}
+		acmeMgr.SetDNSProvider(dnsServer)
+	}
+
+	if getEnvBool("OCSP_STAPLING_ENABLED", true) {
+		if acmeMgr != nil {
+			configMgr.SetOCSPSource(acmeMgr.Certificates)
+		}
+		configMgr.StartOCSPStapling(getEnvSeconds("OCSP_CHECK_INTERVAL", 10*time.Minute))
+		services = append(services, service{"OCSP stapling", configMgr.StopOCSPStapling})
+	}
+
+	httpAddrs := listenAddrs("HTTP_LISTEN", "80")
+	log.Printf("Starting HTTP Proxy on %s...", strings.Join(httpAddrs, ", "))
+	httpProxy, err := proxy.StartHTTPProxy(configMgr, httpAddrs, acmeMgr)
+	if err != nil {
+		startupFailed("HTTP proxy", err)
+	}
+	services = append(services, service{"HTTP proxy", httpProxy.Shutdown})
+
+	httpsAddrs := listenAddrs("HTTPS_LISTEN", "443")
+	log.Printf("Starting HTTPS Proxy on %s...", strings.Join(httpsAddrs, ", "))
+	var http3Addrs []string
+	if getEnvBool("HTTP3_ENABLED", false) {
+		http3Addrs = listenAddrs("HTTP3_LISTEN", "443")
+		log.Printf("Starting HTTP/3 on UDP %s...", strings.Join(http3Addrs, ", "))
+	}
+	httpsProxy, err := proxy.StartHTTPSProxy(configMgr, httpsAddrs, http3Addrs, dohHost, doh, acmeMgr)
+	if err != nil {
+		startupFailed("HTTPS proxy", err)
+	}
+	services = append(services, service{"HTTPS proxy", httpsProxy.Shutdown})
+
+	// Orders start once the proxies can answer challenges
+	if acmeMgr != nil {
+		acmeMgr.Start()
+		services = append(services, service{"ACME client", acmeMgr.Shutdown})
+	}
 
 	log.Println("Starting TCP/UDP Proxy Manager...")
-	go proxy.StartProxyManager(configMgr)
+	proxyManager := proxy.StartProxyManager(configMgr, getEnvString("PROXY_BIND_ADDR", ""))
+	services = append(services, service{"TCP/UDP proxies", proxyManager.Shutdown})
 
-	log.Println("Starting Health Check on :8080...")
-	go health.StartHealthCheck(configMgr)
+	healthAddr := getEnvString("HEALTH_LISTEN", ":8080")
+	log.Printf("Starting Health Check on %s...", healthAddr)
+	healthServer, err := health.StartHealthCheck(configMgr, healthAddr)
+	if err != nil {
+		startupFailed("health check", err)
+	}
+	services = append(services, service{"health check", healthServer.Shutdown})
 
 	log.Println("ggkop Agent started successfully")
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Printf("Received %s, shutting down...", sig)
+	shutdown(services, getEnvSeconds("SHUTDOWN_TIMEOUT", 30*time.Second))
+	if err := dnsServer.Close(); err != nil {
+		log.Printf("Error closing GeoIP databases: %v", err)
+	}
+	log.Println("ggkop Agent stopped")
+}
+
+// service is a running listener that can be drained on shutdown.
+type service struct {
+	name     string
+	shutdown func(context.Context) error
+}
+
+// shutdown drains all services in parallel, giving up after timeout.
+func shutdown(services []service, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, svc := range services {
+		wg.Add(1)
+		go func(svc service) {
+			defer wg.Done()
+			if err := svc.shutdown(ctx); err != nil {
+				log.Printf("Error stopping %s: %v", svc.name, err)
+			}
+		}(svc)
+	}
+	wg.Wait()
+}
+
+// listenAddrs reads a comma-separated list of listen addresses. Entries
+// without a port (a bare IPv4 or IPv6 address) get defaultPort.
+func listenAddrs(key string, defaultPort string) []string {
+	addrs := splitList(getEnvString(key, ":"+defaultPort))
+	for i, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addrs[i] = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+		}
+	}
+	return addrs
+}
+
+func getEnvString(key string, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+// getEnvSeconds reads a duration given in whole seconds.
+func getEnvSeconds(key string, defaultVal time.Duration) time.Duration {
+	return time.Duration(getEnvInt(key, int(defaultVal/time.Second))) * time.Second
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvBool(key string, defaultVal bool) bool {
+	val, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultVal
+	}
+	return val
 }
 
 func getEnvInt(key string, defaultVal int) int {
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ggkop/agent/acme"
+	"github.com/ggkop/agent/config"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// serveACMEChallenge answers an ACME HTTP-01 challenge request with the key
+// authorization Core sent for the domain, or the one of an order placed by
+// acmeMgr. It reports whether it answered; unknown tokens are left to the
+// origin.
+func serveACMEChallenge(w http.ResponseWriter, r *http.Request, domainConfig *config.Domain, acmeMgr *acme.Manager) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+	if token == "" {
+		return false
+	}
+	keyAuth := ""
+	if challenge := domainConfig.SSL.ACMEHTTPChallenge; challenge.Token == token {
+		keyAuth = challenge.KeyAuthorization
+	}
+	if keyAuth == "" {
+		keyAuth, _ = acmeMgr.HTTP01Response(token)
+	}
+	if keyAuth == "" {
+		return false
+	}
+
+	log.Printf("[HTTP] Answering ACME HTTP-01 challenge for %s", r.Host)
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(keyAuth)); err != nil {
+		log.Printf("[HTTP] Error writing ACME challenge response: %v", err)
+	}
+	return true
+}
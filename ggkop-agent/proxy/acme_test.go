@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestServeACMEChallenge(t *testing.T) {
+	domain := &config.Domain{
+		Domain: "example.com",
+		SSL: config.SSL{ACMEHTTPChallenge: config.ACMEHTTPChallenge{
+			Token:            "tok123",
+			KeyAuthorization: "tok123.thumbprint",
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantOK   bool
+		wantBody string
+	}{
+		{"matching token", http.MethodGet, "/.well-known/acme-challenge/tok123", true, "tok123.thumbprint"},
+		{"unknown token", http.MethodGet, "/.well-known/acme-challenge/other", false, ""},
+		{"no token", http.MethodGet, "/.well-known/acme-challenge/", false, ""},
+		{"other path", http.MethodGet, "/tok123", false, ""},
+		{"POST", http.MethodPost, "/.well-known/acme-challenge/tok123", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ok := serveACMEChallenge(rec, httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil), domain, nil)
+
+			if ok != tt.wantOK {
+				t.Fatalf("serveACMEChallenge() = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -1,45 +1,76 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/ggkop/agent/acme"
 	"github.com/ggkop/agent/config"
 	"github.com/ggkop/agent/waf"
 )
 
 type HTTPProxyServer struct {
-	configMgr *config.ConfigManager
-	wafEngine *waf.LuaWAF
-	stats     *HTTPStats
+	configMgr  *config.ConfigManager
+	wafEngine  *waf.LuaWAF
+	stats      *HTTPStats
+	proxy      *reverseProxy
+	acme       *acme.Manager
+	httpServer *http.Server
 }
 
 type HTTPStats struct {
-	TotalRequests   uint64
-	BlockedRequests uint64
-	ProxyErrors     uint64
+	TotalRequests    uint64
+	BlockedRequests  uint64
+	ProxyErrors      uint64
+	Upgrades         uint64 // connections switched to WebSocket or another protocol
+	ActiveUpgrades   int64
+	Retries          uint64 // requests resent to another upstream
+	UpstreamsEjected uint64 // upstreams taken out after consecutive errors
 }
 
-func StartHTTPProxy(configMgr *config.ConfigManager) {
+// StartHTTPProxy binds every address and serves the HTTP proxy on them in
+// the background. acmeMgr, if not nil, supplies HTTP-01 challenge answers.
+func StartHTTPProxy(configMgr *config.ConfigManager, addrs []string, acmeMgr *acme.Manager) (*HTTPProxyServer, error) {
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+
 	server := &HTTPProxyServer{
 		configMgr: configMgr,
 		wafEngine: waf.NewLuaWAF(),
 		stats:     &HTTPStats{},
+		acme:      acmeMgr,
 	}
+	server.proxy = newReverseProxy(configMgr, "HTTP", server.stats)
 
-	httpServer := &http.Server{
-		Addr:         ":80",
-		Handler:      http.HandlerFunc(server.handleRequest),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	server.httpServer = &http.Server{
+		Handler:           http.HandlerFunc(server.handleRequest),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		// No WriteTimeout: streamed responses such as SSE may stay open
+		// indefinitely. Slow upstreams are bounded by the transport.
 	}
 
-	log.Fatal(httpServer.ListenAndServe())
+	for _, listener := range listeners {
+		go serveHTTP(server.httpServer, listener, "HTTP", false)
+	}
+
+	return server, nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones until ctx
+// expires.
+func (s *HTTPProxyServer) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	s.proxy.close()
+	return err
 }
 
 func (s *HTTPProxyServer) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -52,13 +83,18 @@ func (s *HTTPProxyServer) handleRequest(w http.ResponseWriter, r *http.Request)
 
 	log.Printf("[HTTP] Request: %s %s from %s", r.Method, r.Host+r.RequestURI, r.RemoteAddr)
 
-	domainConfig := s.configMgr.GetDomain(host)
+	domainConfig := s.configMgr.FindDomain(host)
 	if domainConfig == nil {
 		log.Printf("[HTTP] Domain not found: %s", host)
 		http.Error(w, "Domain not found", http.StatusNotFound)
 		return
 	}
 
+	// Challenges must be answered even for HTTPS-only or unproxied domains
+	if serveACMEChallenge(w, r, domainConfig, s.acme) {
+		return
+	}
+
 	// Check if HTTP proxy is enabled OR if any DNS record has HTTPProxyEnabled
 	httpEnabled := domainConfig.HTTPProxy.Enabled
 	if !httpEnabled {
@@ -78,9 +114,9 @@ func (s *HTTPProxyServer) handleRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if domainConfig.HTTPProxy.Type == "https" {
-		log.Printf("[HTTP] Only HTTPS allowed for domain: %s", host)
-		http.Error(w, "HTTPS only", http.StatusForbidden)
+	// Plain HTTP would bypass a required client certificate
+	if domainConfig.HTTPProxy.Type == "https" || requiresClientCert(domainConfig.SSL.TLS) {
+		redirectToHTTPS(w, r, host)
 		return
 	}
 
@@ -103,86 +139,25 @@ func (s *HTTPProxyServer) handleRequest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	target := s.findProxyTarget(domainConfig, host)
-	if target == "" {
+	route := routeRequest(domainConfig, host, r)
+	if len(route.targets) == 0 {
 		log.Printf("[HTTP] No backend found for: %s", host)
 		http.Error(w, "No backend available", http.StatusBadGateway)
 		atomic.AddUint64(&s.stats.ProxyErrors, 1)
 		return
 	}
 
-	s.proxyRequest(w, r, target)
-}
-
-func (s *HTTPProxyServer) findProxyTarget(domainConfig *config.Domain, host string) string {
-	for _, record := range domainConfig.DNSRecords {
-		if record.HTTPProxyEnabled {
-			if record.Type == "A" || record.Type == "AAAA" {
-				return record.Value
-			}
-		}
-	}
-
-	if len(domainConfig.DNSRecords) > 0 {
-		for _, record := range domainConfig.DNSRecords {
-			if record.Type == "A" || record.Type == "AAAA" {
-				return record.Value
-			}
-		}
-	}
-
-	return ""
+	s.proxy.serve(w, r, route, domainConfig.HTTPProxy)
 }
 
-func (s *HTTPProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, target string) {
-	targetURL := fmt.Sprintf("http://%s%s", target, r.RequestURI)
-
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		log.Printf("[HTTP] Error creating proxy request: %v", err)
-		http.Error(w, "Proxy error", http.StatusInternalServerError)
-		atomic.AddUint64(&s.stats.ProxyErrors, 1)
-		return
+// redirectToHTTPS sends the client to the same URL over HTTPS. GET and HEAD
+// get 301; other methods get 308 so the method and body are kept.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request, host string) {
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
 	}
-
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
-		}
-	}
-
-	proxyReq.Header.Set("X-Forwarded-For", getClientIP(r))
-	proxyReq.Header.Set("X-Forwarded-Proto", "http")
-	proxyReq.Header.Set("X-Real-IP", getClientIP(r))
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		log.Printf("[HTTP] Error proxying request: %v", err)
-		http.Error(w, "Backend error", http.StatusBadGateway)
-		atomic.AddUint64(&s.stats.ProxyErrors, 1)
-		return
-	}
-	defer resp.Body.Close()
-
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
-
-	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("[HTTP] Error copying response body: %v", err)
-	}
-
-	log.Printf("[HTTP] Proxied: %s → %s (status: %d)", r.Host+r.RequestURI, target, resp.StatusCode)
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
 }
 
 func getClientIP(r *http.Request) string {
@@ -204,8 +179,12 @@ func getClientIP(r *http.Request) string {
 
 func (s *HTTPProxyServer) GetStats() HTTPStats {
 	return HTTPStats{
-		TotalRequests:   atomic.LoadUint64(&s.stats.TotalRequests),
-		BlockedRequests: atomic.LoadUint64(&s.stats.BlockedRequests),
-		ProxyErrors:     atomic.LoadUint64(&s.stats.ProxyErrors),
+		TotalRequests:    atomic.LoadUint64(&s.stats.TotalRequests),
+		BlockedRequests:  atomic.LoadUint64(&s.stats.BlockedRequests),
+		ProxyErrors:      atomic.LoadUint64(&s.stats.ProxyErrors),
+		Upgrades:         atomic.LoadUint64(&s.stats.Upgrades),
+		ActiveUpgrades:   atomic.LoadInt64(&s.stats.ActiveUpgrades),
+		Retries:          atomic.LoadUint64(&s.stats.Retries),
+		UpstreamsEjected: atomic.LoadUint64(&s.stats.UpstreamsEjected),
 	}
 }
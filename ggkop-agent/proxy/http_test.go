@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		method     string
+		target     string
+		wantStatus int
+		wantURL    string
+	}{
+		{http.MethodGet, "http://example.com:80/path?q=1", http.StatusMovedPermanently, "https://example.com/path?q=1"},
+		{http.MethodHead, "http://example.com/", http.StatusMovedPermanently, "https://example.com/"},
+		{http.MethodPost, "http://example.com/form", http.StatusPermanentRedirect, "https://example.com/form"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			redirectToHTTPS(rec, httptest.NewRequest(tt.method, tt.target, nil), "example.com")
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantURL {
+				t.Errorf("Location = %s, want %s", got, tt.wantURL)
+			}
+		})
+	}
+}
@@ -1,95 +1,195 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/ggkop/agent/acme"
 	"github.com/ggkop/agent/config"
 	"github.com/ggkop/agent/waf"
+	"github.com/quic-go/quic-go/http3"
 )
 
 type HTTPSProxyServer struct {
-	configMgr *config.ConfigManager
-	wafEngine *waf.LuaWAF
-	stats     *HTTPStats
+	configMgr   *config.ConfigManager
+	wafEngine   *waf.LuaWAF
+	stats       *HTTPStats
+	proxy       *reverseProxy
+	doh         http.Handler
+	dohHost     string
+	acme        *acme.Manager
+	httpsServer *http.Server
+	http3Server *http3.Server // nil unless HTTP/3 is enabled
+	packetConns []net.PacketConn
+	altSvc      string
 }
 
-func StartHTTPSProxy(configMgr *config.ConfigManager) {
+// StartHTTPSProxy binds every address and serves the HTTPS proxy on them in
+// the background. When doh is not nil it answers DNS-over-HTTPS requests on
+// /dns-query of dohHost; other hosts proxy that path as usual. acmeMgr, if
+// not nil, supplies the certificates it obtained and answers TLS-ALPN-01
+// challenges. HTTP/3 is served on the UDP addresses in http3Addrs, if any,
+// and advertised with Alt-Svc.
+func StartHTTPSProxy(configMgr *config.ConfigManager, addrs, http3Addrs []string, dohHost string, doh http.Handler, acmeMgr *acme.Manager) (*HTTPSProxyServer, error) {
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPS proxy: %w", err)
+	}
+	packetConns, err := listenAllUDP(http3Addrs)
+	if err != nil {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("HTTP/3: %w", err)
+	}
+
 	server := &HTTPSProxyServer{
 		configMgr: configMgr,
 		wafEngine: waf.NewLuaWAF(),
 		stats:     &HTTPStats{},
+		doh:       doh,
+		dohHost:   dohHost,
+		acme:      acmeMgr,
 	}
+	server.proxy = newReverseProxy(configMgr, "HTTPS", server.stats)
 
 	tlsConfig := &tls.Config{
 		GetCertificate: server.getCertificate,
 		MinVersion:     tls.VersionTLS12,
 	}
+	var extraProtos []string
+	if acmeMgr != nil {
+		extraProtos = []string{acme.ALPNProto}
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	tlsConfig.GetConfigForClient = newTLSPolicies(configMgr, tlsConfig, extraProtos).getConfigForClient
+
+	server.httpsServer = &http.Server{
+		Handler:           http.HandlerFunc(server.handleRequest),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		// No WriteTimeout: streamed responses such as SSE may stay open
+		// indefinitely. Slow upstreams are bounded by the transport.
+	}
 
-	httpsServer := &http.Server{
-		Addr:         ":443",
-		Handler:      http.HandlerFunc(server.handleRequest),
-		TLSConfig:    tlsConfig,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	for _, listener := range listeners {
+		go serveHTTP(server.httpsServer, listener, "HTTPS", true)
 	}
 
-	log.Fatal(httpsServer.ListenAndServeTLS("", ""))
+	if len(packetConns) > 0 {
+		// Same handler and certificates; quic-go offers h3 instead of the
+		// TCP protocols.
+		server.http3Server = &http3.Server{
+			Handler:     http.HandlerFunc(server.handleRequest),
+			TLSConfig:   tlsConfig,
+			IdleTimeout: 120 * time.Second,
+		}
+		server.packetConns = packetConns
+		server.altSvc = altSvcHeader(packetConns)
+		for _, conn := range packetConns {
+			go serveHTTP3(server.http3Server, conn)
+		}
+	}
+
+	return server, nil
 }
 
-func (s *HTTPSProxyServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	domainConfig := s.configMgr.GetDomain(hello.ServerName)
-	if domainConfig == nil {
-		log.Printf("[HTTPS] No config found for domain: %s", hello.ServerName)
-		return nil, errors.New("no certificate available")
+// Shutdown stops accepting requests and waits for in-flight ones until ctx
+// expires.
+func (s *HTTPSProxyServer) Shutdown(ctx context.Context) error {
+	err := s.httpsServer.Shutdown(ctx)
+	if s.http3Server != nil {
+		if h3err := s.http3Server.Shutdown(ctx); err == nil {
+			err = h3err
+		}
+		for _, conn := range s.packetConns {
+			conn.Close()
+		}
 	}
+	s.proxy.close()
+	return err
+}
 
-	if !domainConfig.SSL.Enabled {
-		log.Printf("[HTTPS] SSL not enabled for domain: %s", hello.ServerName)
-		return nil, errors.New("ssl not enabled")
+func serveHTTP3(srv *http3.Server, conn net.PacketConn) {
+	log.Printf("[HTTPS] HTTP/3 listening on %s", conn.LocalAddr())
+	if err := srv.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[HTTPS] HTTP/3 server on %s stopped: %v", conn.LocalAddr(), err)
 	}
+}
 
-	if domainConfig.SSL.Certificate == "" || domainConfig.SSL.PrivateKey == "" {
-		log.Printf("[HTTPS] Certificate or key missing for domain: %s", hello.ServerName)
-		return nil, errors.New("certificate or key missing")
+// altSvcHeader advertises HTTP/3 on the ports of conns.
+func altSvcHeader(conns []net.PacketConn) string {
+	var entries []string
+	seen := make(map[int]bool)
+	for _, conn := range conns {
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		if !seen[port] {
+			seen[port] = true
+			entries = append(entries, fmt.Sprintf(`h3=":%d"; ma=86400`, port))
+		}
 	}
+	return strings.Join(entries, ", ")
+}
 
-	cert, err := tls.X509KeyPair(
-		[]byte(domainConfig.SSL.Certificate),
-		[]byte(domainConfig.SSL.PrivateKey),
-	)
+func (s *HTTPSProxyServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := s.acme.TLSALPNCertificate(hello); ok {
+		log.Printf("[HTTPS] Answering ACME TLS-ALPN-01 challenge for %s", hello.ServerName)
+		return cert, nil
+	}
+	if cert, ok := s.acme.Certificate(hello.ServerName); ok && hello.SupportsCertificate(cert) == nil {
+		return s.configMgr.Staple(cert), nil
+	}
+
+	cert, err := s.configMgr.GetCertificate(hello)
 	if err != nil {
-		log.Printf("[HTTPS] Error loading certificate for %s: %v", hello.ServerName, err)
+		log.Printf("[HTTPS] No certificate for %s: %v", hello.ServerName, err)
 		return nil, err
 	}
-
-	log.Printf("[HTTPS] Certificate loaded for: %s", hello.ServerName)
-	return &cert, nil
+	return cert, nil
 }
 
 func (s *HTTPSProxyServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	atomic.AddUint64(&s.stats.TotalRequests, 1)
+	// Only the identity verified by the handshake may reach the WAF and origin
+	stripClientCertHeaders(r.Header)
 
 	host := r.Host
 	if idx := strings.Index(host, ":"); idx != -1 {
 		host = host[:idx]
 	}
 
+	if s.doh != nil && r.URL.Path == "/dns-query" && strings.EqualFold(host, s.dohHost) {
+		s.doh.ServeHTTP(w, r)
+		return
+	}
+
 	log.Printf("[HTTPS] Request: %s %s from %s", r.Method, r.Host+r.RequestURI, r.RemoteAddr)
 
-	domainConfig := s.configMgr.GetDomain(host)
+	domainConfig := s.configMgr.FindDomain(host)
 	if domainConfig == nil {
 		log.Printf("[HTTPS] Domain not found: %s", host)
 		http.Error(w, "Domain not found", http.StatusNotFound)
 		return
 	}
+	if misdirected(r, domainConfig, s.configMgr) {
+		log.Printf("[HTTPS] Misdirected request for %s on connection for %q", host, r.TLS.ServerName)
+		http.Error(w, "Misdirected request", http.StatusMisdirectedRequest)
+		return
+	}
+	if s.altSvc != "" && allowsHTTP3(domainConfig.SSL.TLS) {
+		w.Header().Set("Alt-Svc", s.altSvc)
+	}
 
 	// Check if HTTP proxy is enabled OR if any DNS record has HTTPProxyEnabled
 	httpEnabled := domainConfig.HTTPProxy.Enabled
@@ -116,6 +216,11 @@ func (s *HTTPSProxyServer) handleRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	hsts := hstsHeader(domainConfig.SSL.HSTS)
+	if hsts != "" {
+		w.Header().Set("Strict-Transport-Security", hsts)
+	}
+
 	if domainConfig.LuaCode != "" {
 		blocked, response := s.wafEngine.Execute(domainConfig.LuaCode, r)
 		
@@ -135,92 +240,51 @@ func (s *HTTPSProxyServer) handleRequest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	target := s.findProxyTarget(domainConfig, host)
-	if target == "" {
+	route := routeRequest(domainConfig, host, r)
+	if len(route.targets) == 0 {
 		log.Printf("[HTTPS] No backend found for: %s", host)
 		http.Error(w, "No backend available", http.StatusBadGateway)
 		atomic.AddUint64(&s.stats.ProxyErrors, 1)
 		return
 	}
 
-	s.proxyRequest(w, r, target)
-}
-
-func (s *HTTPSProxyServer) findProxyTarget(domainConfig *config.Domain, host string) string {
-	for _, record := range domainConfig.DNSRecords {
-		if record.HTTPProxyEnabled {
-			if record.Type == "A" || record.Type == "AAAA" {
-				return record.Value
-			}
-		}
+	if hsts != "" {
+		// Our policy replaces the origin's
+		route.removeResponseHeader("Strict-Transport-Security")
 	}
+	route.clientCert = clientCertificate(r, domainConfig, s.configMgr)
 
-	if len(domainConfig.DNSRecords) > 0 {
-		for _, record := range domainConfig.DNSRecords {
-			if record.Type == "A" || record.Type == "AAAA" {
-				return record.Value
-			}
-		}
-	}
-
-	return ""
+	s.proxy.serve(w, r, route, domainConfig.HTTPProxy)
 }
 
-func (s *HTTPSProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, target string) {
-	targetURL := fmt.Sprintf("http://%s%s", target, r.RequestURI)
-
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		log.Printf("[HTTPS] Error creating proxy request: %v", err)
-		http.Error(w, "Proxy error", http.StatusInternalServerError)
-		atomic.AddUint64(&s.stats.ProxyErrors, 1)
-		return
-	}
-
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
-		}
+// hstsHeader formats the Strict-Transport-Security value, or "" when HSTS is
+// disabled.
+func hstsHeader(hsts config.HSTS) string {
+	if !hsts.Enabled {
+		return ""
 	}
-
-	proxyReq.Header.Set("X-Forwarded-For", getClientIP(r))
-	proxyReq.Header.Set("X-Forwarded-Proto", "https")
-	proxyReq.Header.Set("X-Real-IP", getClientIP(r))
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	maxAge := hsts.MaxAge
+	if maxAge <= 0 {
+		maxAge = 31536000
 	}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		log.Printf("[HTTPS] Error proxying request: %v", err)
-		http.Error(w, "Backend error", http.StatusBadGateway)
-		atomic.AddUint64(&s.stats.ProxyErrors, 1)
-		return
+	value := "max-age=" + strconv.Itoa(maxAge)
+	if hsts.IncludeSubDomains {
+		value += "; includeSubDomains"
 	}
-	defer resp.Body.Close()
-
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if hsts.Preload {
+		value += "; preload"
 	}
-
-	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("[HTTPS] Error copying response body: %v", err)
-	}
-
-	log.Printf("[HTTPS] Proxied: %s → %s (status: %d)", r.Host+r.RequestURI, target, resp.StatusCode)
+	return value
 }
 
 func (s *HTTPSProxyServer) GetStats() HTTPStats {
 	return HTTPStats{
-		TotalRequests:   atomic.LoadUint64(&s.stats.TotalRequests),
-		BlockedRequests: atomic.LoadUint64(&s.stats.BlockedRequests),
-		ProxyErrors:     atomic.LoadUint64(&s.stats.ProxyErrors),
+		TotalRequests:    atomic.LoadUint64(&s.stats.TotalRequests),
+		BlockedRequests:  atomic.LoadUint64(&s.stats.BlockedRequests),
+		ProxyErrors:      atomic.LoadUint64(&s.stats.ProxyErrors),
+		Upgrades:         atomic.LoadUint64(&s.stats.Upgrades),
+		ActiveUpgrades:   atomic.LoadInt64(&s.stats.ActiveUpgrades),
+		Retries:          atomic.LoadUint64(&s.stats.Retries),
+		UpstreamsEjected: atomic.LoadUint64(&s.stats.UpstreamsEjected),
 	}
 }
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ggkop/agent/config"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHSTSHeader(t *testing.T) {
+	tests := []struct {
+		hsts config.HSTS
+		want string
+	}{
+		{config.HSTS{}, ""},
+		{config.HSTS{Enabled: true}, "max-age=31536000"},
+		{config.HSTS{Enabled: true, MaxAge: 300, IncludeSubDomains: true}, "max-age=300; includeSubDomains"},
+		{config.HSTS{Enabled: true, MaxAge: 63072000, IncludeSubDomains: true, Preload: true}, "max-age=63072000; includeSubDomains; preload"},
+	}
+
+	for _, tt := range tests {
+		if got := hstsHeader(tt.hsts); got != tt.want {
+			t.Errorf("hstsHeader(%+v) = %q, want %q", tt.hsts, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPSProxyHTTP3(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	// httptest's certificate is valid for example.com
+	certSource := httptest.NewTLSServer(http.NotFoundHandler())
+	certSource.Close()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certSource.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := config.Domain{
+		Domain:     "example.com",
+		DNSRecords: []config.DNSRecord{{Name: "@", Type: "A", Value: strings.TrimPrefix(backend.URL, "http://")}},
+		HTTPProxy:  config.HTTPProxy{Enabled: true},
+		SSL: config.SSL{
+			Enabled:     true,
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certSource.Certificate().Raw})),
+			PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		},
+	}
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(config.PollResponse{Success: true, Domains: []config.Domain{domain}})
+	}))
+	defer core.Close()
+
+	configMgr := config.NewConfigManager(core.URL, "agent", "key")
+	go configMgr.StartPolling(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); configMgr.FindDomain("example.com") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration not loaded")
+		}
+	}
+
+	server, err := StartHTTPSProxy(configMgr, []string{"127.0.0.1:0"}, []string{"127.0.0.1:0"}, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certSource.Certificate())
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	defer transport.Close()
+
+	addr := server.packetConns[0].LocalAddr().String()
+	req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+	req.Host = "example.com"
+	resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.Proto != "HTTP/3.0" || string(body) != "hello https" {
+		t.Errorf("response = %s %q, want HTTP/3.0 \"hello https\"", resp.Proto, body)
+	}
+	wantAltSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, addr[strings.LastIndex(addr, ":")+1:])
+	if got := resp.Header.Get("Alt-Svc"); got != wantAltSvc {
+		t.Errorf("Alt-Svc = %q, want %q", got, wantAltSvc)
+	}
+}
+
+func TestHTTPSProxyDoHHost(t *testing.T) {
+	server := &HTTPSProxyServer{
+		configMgr: config.NewConfigManager("http://core.invalid", "agent", "key"),
+		stats:     &HTTPStats{},
+		doh: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}),
+		dohHost: "dns.example.net",
+	}
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"https://dns.example.net/dns-query", http.StatusTeapot},
+		{"https://DNS.example.net:443/dns-query", http.StatusTeapot},
+		{"https://example.com/dns-query", http.StatusNotFound},
+		{"https://dns.example.net/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.handleRequest(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.url, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// listenAll binds a TCP listener on every address. If one fails, the ones
+// already bound are closed.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenAllUDP binds a UDP socket on every address. If one fails, the ones
+// already bound are closed.
+func listenAllUDP(addrs []string) ([]net.PacketConn, error) {
+	conns := make([]net.PacketConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// serveHTTP runs srv on listener until it is shut down. certificates come
+// from srv.TLSConfig when useTLS is set.
+func serveHTTP(srv *http.Server, listener net.Listener, tag string, useTLS bool) {
+	log.Printf("[%s] Listening on %s", tag, listener.Addr())
+
+	var err error
+	if useTLS {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[%s] Server on %s stopped: %v", tag, listener.Addr(), err)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+// originKey identifies a pooled transport: requests share connections only
+// when they go to the same address with the same TLS settings.
+type originKey struct {
+	scheme  string // http, https or h2
+	address string // host:port, IPv6 bracketed
+	sni     string
+	verify  string
+	caCert  string
+}
+
+// newOriginKey resolves the connection settings for a request to target.
+// host is the requested host name, the default TLS server name.
+func newOriginKey(target string, origin config.Origin, host string) (originKey, error) {
+	key := originKey{
+		scheme: strings.ToLower(origin.Scheme),
+		verify: strings.ToLower(origin.Verify),
+	}
+	if key.scheme == "" {
+		key.scheme = "http"
+	}
+	if key.verify == "" {
+		key.verify = "verify"
+	}
+
+	defaultPort := 80
+	switch key.scheme {
+	case "http":
+		key.verify = ""
+	case "https", "h2":
+		defaultPort = 443
+		key.sni = origin.SNI
+		if key.sni == "" {
+			key.sni = origin.HostHeader
+		}
+		if key.sni == "" {
+			key.sni = host
+		}
+	default:
+		return originKey{}, fmt.Errorf("unknown origin scheme %q", origin.Scheme)
+	}
+
+	switch key.verify {
+	case "", "verify", "skip":
+	case "pinned":
+		if origin.CACert == "" {
+			return originKey{}, errors.New("verify=pinned requires caCert")
+		}
+		key.caCert = origin.CACert
+	default:
+		return originKey{}, fmt.Errorf("unknown origin verify mode %q", origin.Verify)
+	}
+
+	port := origin.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	key.address = originAddress(target, port)
+	return key, nil
+}
+
+// urlScheme is the scheme of the outgoing request URL.
+func (k originKey) urlScheme() string {
+	if k.scheme == "h2" {
+		return "https"
+	}
+	return k.scheme
+}
+
+// newTransport builds the pooled transport for the origin. https speaks
+// HTTP/1.1 only, h2 negotiates HTTP/2 over TLS (upgrade requests still use
+// HTTP/1.1).
+func (k originKey) newTransport() (*http.Transport, error) {
+	t := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if k.scheme == "http" {
+		return t, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: k.sni,
+		MinVersion: tls.VersionTLS12,
+	}
+	switch k.verify {
+	case "skip":
+		tlsConfig.InsecureSkipVerify = true
+	case "pinned":
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(k.caCert)) {
+			return nil, errors.New("no valid certificate in caCert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	t.TLSClientConfig = tlsConfig
+
+	if k.scheme == "h2" {
+		t.ForceAttemptHTTP2 = true
+	} else {
+		// A non-nil empty map disables HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t, nil
+}
+
+// originAddress joins target with port unless it already has one, bracketing
+// IPv6 addresses.
+func originAddress(target string, port int) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.Trim(target, "[]"), strconv.Itoa(port))
+}
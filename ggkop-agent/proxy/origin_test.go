@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestNewOriginKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		origin  config.Origin
+		want    originKey
+		wantErr bool
+	}{
+		{"default", "192.0.2.10", config.Origin{}, originKey{scheme: "http", address: "192.0.2.10:80"}, false},
+		{"port", "192.0.2.10", config.Origin{Port: 8080}, originKey{scheme: "http", address: "192.0.2.10:8080"}, false},
+		{"record port wins", "192.0.2.10:9000", config.Origin{Port: 8080}, originKey{scheme: "http", address: "192.0.2.10:9000"}, false},
+		{"https", "2001:db8::1", config.Origin{Scheme: "https"}, originKey{scheme: "https", address: "[2001:db8::1]:443", sni: "example.com", verify: "verify"}, false},
+		{"sni from host header", "192.0.2.10", config.Origin{Scheme: "h2", HostHeader: "origin.example.net", Verify: "skip"}, originKey{scheme: "h2", address: "192.0.2.10:443", sni: "origin.example.net", verify: "skip"}, false},
+		{"sni override", "192.0.2.10", config.Origin{Scheme: "https", SNI: "tls.example.net", HostHeader: "origin.example.net"}, originKey{scheme: "https", address: "192.0.2.10:443", sni: "tls.example.net", verify: "verify"}, false},
+		{"pinned without CA", "192.0.2.10", config.Origin{Scheme: "https", Verify: "pinned"}, originKey{}, true},
+		{"unknown scheme", "192.0.2.10", config.Origin{Scheme: "ftp"}, originKey{}, true},
+		{"unknown verify", "192.0.2.10", config.Origin{Scheme: "https", Verify: "maybe"}, originKey{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newOriginKey(tt.target, tt.origin, "example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOriginKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("newOriginKey() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReverseProxyTLSOrigin(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto+" "+r.Host)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}))
+	target := strings.TrimPrefix(backend.URL, "https://")
+
+	tests := []struct {
+		name       string
+		origin     config.Origin
+		wantStatus int
+		wantBody   string
+	}{
+		{"verify fails", config.Origin{Scheme: "https"}, http.StatusBadGateway, ""},
+		{"skip", config.Origin{Scheme: "https", Verify: "skip"}, http.StatusOK, "HTTP/1.1 " + target},
+		{"pinned h2", config.Origin{Scheme: "h2", Verify: "pinned", CACert: caPEM, SNI: "example.com", HostHeader: "origin.example.net"}, http.StatusOK, "HTTP/2.0 origin.example.net"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy(config.NewConfigManager("", "", ""), "HTTPS", &HTTPStats{})
+			rec := httptest.NewRecorder()
+			rp.serve(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), proxyRoute{name: "example.com", targets: []string{target}}, config.HTTPProxy{Origin: tt.origin})
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+// flushInterval is how often buffered response bodies are flushed to the
+// client. Server-sent events (text/event-stream) are flushed immediately.
+const flushInterval = 100 * time.Millisecond
+
+type proxyStateKey struct{}
+
+// proxyState follows a request through the httputil callbacks.
+type proxyState struct {
+	pool     *upstreamPool
+	origin   config.Origin
+	headers  config.HeaderRules // applied to the response
+	cert     *x509.Certificate  // forwarded as X-Client-* headers
+	host     string             // requested host, the default TLS server name
+	address  string             // origin address of the last attempt
+	upgraded bool
+}
+
+// reverseProxy is the proxy core shared by the HTTP and HTTPS servers. It
+// balances each domain over its upstream pool, keeps one pooled transport
+// per origin so connections are reused across requests, and drops the pools
+// and transports of domains and origins that leave the configuration.
+type reverseProxy struct {
+	tag   string
+	stats *HTTPStats
+	proxy *httputil.ReverseProxy
+
+	mu         sync.RWMutex
+	pools      map[string]*upstreamPool
+	transports map[originKey]*http.Transport
+	upgrades   map[*proxyState]context.CancelFunc
+}
+
+func newReverseProxy(configMgr *config.ConfigManager, tag string, stats *HTTPStats) *reverseProxy {
+	rp := &reverseProxy{
+		tag:        tag,
+		stats:      stats,
+		pools:      make(map[string]*upstreamPool),
+		transports: make(map[originKey]*http.Transport),
+		upgrades:   make(map[*proxyState]context.CancelFunc),
+	}
+
+	rp.proxy = &httputil.ReverseProxy{
+		Rewrite:        rp.rewrite,
+		Transport:      rp,
+		FlushInterval:  flushInterval,
+		ModifyResponse: rp.modifyResponse,
+		ErrorHandler:   rp.errorHandler,
+		ErrorLog:       log.New(log.Writer(), "["+tag+"] ", log.Flags()),
+	}
+
+	configMgr.OnUpdate(rp.configure)
+
+	return rp
+}
+
+// configure builds the upstream pool of every proxied record owner and
+// route rule of cfg and drops the transports of origins no longer used.
+func (rp *reverseProxy) configure(cfg *config.Config) {
+	pools := make(map[string]poolConfig)
+	active := make(map[string]bool)
+	for i := range cfg.Domains {
+		domain := &cfg.Domains[i]
+		lb := domain.HTTPProxy.LoadBalancing
+		for _, record := range domain.DNSRecords {
+			if record.Type != "A" && record.Type != "AAAA" {
+				continue
+			}
+			active[addressHost(record.Value)] = true
+			owner := recordOwner(record.Name, domain.Domain)
+			if _, ok := pools[owner]; !ok {
+				_, targets := findProxyTargets(domain, owner)
+				pools[owner] = poolConfig{targets, lb}
+			}
+		}
+		for i, rule := range domain.HTTPProxy.Routes {
+			pools[rulePoolName(domain.Domain, i)] = poolConfig{rule.Upstreams, lb}
+			for _, target := range rule.Upstreams {
+				active[addressHost(target)] = true
+			}
+		}
+	}
+	rp.retain(pools, active)
+}
+
+// serve proxies r to one of the route's upstreams, using the origin and
+// load-balancing settings of proxyConfig. Hop-by-hop headers
+// are stripped in both directions, trailers are passed through and
+// X-Forwarded-* are set. Upgrade requests (WebSocket, h2c) are spliced to
+// the origin once it answers 101 Switching Protocols.
+func (rp *reverseProxy) serve(w http.ResponseWriter, r *http.Request, route proxyRoute, proxyConfig config.HTTPProxy) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, err := newOriginKey(route.targets[0], proxyConfig.Origin, host); err != nil {
+		atomic.AddUint64(&rp.stats.ProxyErrors, 1)
+		log.Printf("[%s] Invalid origin settings for %s: %v", rp.tag, host, err)
+		http.Error(w, "Origin misconfigured", http.StatusBadGateway)
+		return
+	}
+
+	state := &proxyState{
+		pool:    rp.pool(route.name, route.targets, proxyConfig.LoadBalancing),
+		origin:  proxyConfig.Origin,
+		headers: route.responseHeaders,
+		cert:    route.clientCert,
+		host:    host,
+	}
+	ctx := context.WithValue(r.Context(), proxyStateKey{}, state)
+
+	if isUpgradeRequest(r) {
+		// The server's read timeout would otherwise cut the spliced
+		// connection, and Shutdown does not track hijacked connections.
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		rp.mu.Lock()
+		rp.upgrades[state] = cancel
+		rp.mu.Unlock()
+		defer func() {
+			rp.mu.Lock()
+			delete(rp.upgrades, state)
+			rp.mu.Unlock()
+		}()
+	}
+
+	rp.proxy.ServeHTTP(w, r.WithContext(ctx))
+
+	if state.upgraded {
+		atomic.AddInt64(&rp.stats.ActiveUpgrades, -1)
+		log.Printf("[%s] Upgraded connection closed: %s → %s", rp.tag, r.Host+r.RequestURI, state.address)
+	}
+}
+
+func (rp *reverseProxy) rewrite(pr *httputil.ProxyRequest) {
+	// Scheme, address and Host are set per attempt in RoundTrip
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Real-IP", getClientIP(pr.In))
+	state := pr.In.Context().Value(proxyStateKey{}).(*proxyState)
+	setClientCertHeaders(pr.Out.Header, state.cert)
+}
+
+func (rp *reverseProxy) modifyResponse(resp *http.Response) error {
+	state := resp.Request.Context().Value(proxyStateKey{}).(*proxyState)
+	applyHeaderRules(resp.Header, state.headers)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		state.upgraded = true
+		atomic.AddUint64(&rp.stats.Upgrades, 1)
+		atomic.AddInt64(&rp.stats.ActiveUpgrades, 1)
+	}
+
+	log.Printf("[%s] Proxied: %s → %s (status: %d)",
+		rp.tag, resp.Request.Header.Get("X-Forwarded-Host")+resp.Request.URL.RequestURI(), resp.Request.URL.Host, resp.StatusCode)
+	return nil
+}
+
+func (rp *reverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	atomic.AddUint64(&rp.stats.ProxyErrors, 1)
+	log.Printf("[%s] Error proxying request to %s: %v", rp.tag, r.Context().Value(proxyStateKey{}).(*proxyState).address, err)
+	http.Error(w, "Backend error", http.StatusBadGateway)
+}
+
+// RoundTrip sends req to an upstream picked from the request's pool.
+// Idempotent requests without a body move on to the next upstream when
+// the connection fails.
+func (rp *reverseProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	state := req.Context().Value(proxyStateKey{}).(*proxyState)
+	lb, failTimeout := state.pool.settings()
+
+	attempts := 1
+	if lb.Retries > 0 && isIdempotent(req) {
+		attempts += lb.Retries
+	}
+
+	tried := make(map[*upstream]bool)
+	err := errors.New("no upstream available")
+	for i := 0; i < attempts; i++ {
+		u := state.pool.pick(req, tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		if i > 0 {
+			atomic.AddUint64(&rp.stats.Retries, 1)
+			log.Printf("[%s] Retrying %s on %s after: %v", rp.tag, req.Method, u.target, err)
+		}
+
+		var resp *http.Response
+		resp, err = rp.roundTripUpstream(req, state, u)
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				rp.upstreamFailed(u, lb.MaxFails, failTimeout)
+			default:
+				u.success()
+			}
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			// The client went away; not the upstream's fault
+			break
+		}
+		rp.upstreamFailed(u, lb.MaxFails, failTimeout)
+	}
+	return nil, err
+}
+
+func (rp *reverseProxy) roundTripUpstream(req *http.Request, state *proxyState, u *upstream) (*http.Response, error) {
+	key, err := newOriginKey(u.target, state.origin, state.host)
+	if err != nil {
+		return nil, err
+	}
+	t, err := rp.transport(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = key.urlScheme()
+	out.URL.Host = key.address
+	out.Host = state.origin.HostHeader
+	if out.Host == "" {
+		out.Host = upstreamHost(u.target)
+	}
+	state.address = key.address
+
+	atomic.AddInt64(&u.active, 1)
+	resp, err := t.RoundTrip(out)
+	if err != nil {
+		atomic.AddInt64(&u.active, -1)
+		return nil, err
+	}
+	resp.Body = trackBody(resp.Body, func() { atomic.AddInt64(&u.active, -1) })
+	return resp, nil
+}
+
+func (rp *reverseProxy) upstreamFailed(u *upstream, maxFails int, failTimeout time.Duration) {
+	if u.failure(maxFails, failTimeout) {
+		atomic.AddUint64(&rp.stats.UpstreamsEjected, 1)
+		log.Printf("[%s] Upstream %s ejected for %s after %d consecutive errors", rp.tag, u.target, failTimeout, maxFails)
+	}
+}
+
+// poolConfig is what an upstream pool is built from.
+type poolConfig struct {
+	targets []string
+	lb      config.LoadBalancing
+}
+
+// pool returns the upstream pool called name. Pools are kept up to date by
+// retain on every configuration change; one the change has not reached yet
+// is created from targets and lb.
+func (rp *reverseProxy) pool(name string, targets []string, lb config.LoadBalancing) *upstreamPool {
+	rp.mu.RLock()
+	p, ok := rp.pools[name]
+	rp.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if p, ok = rp.pools[name]; !ok {
+		p = &upstreamPool{}
+		p.update(targets, lb)
+		rp.pools[name] = p
+	}
+	return p
+}
+
+func (rp *reverseProxy) transport(key originKey) (*http.Transport, error) {
+	rp.mu.RLock()
+	t, ok := rp.transports[key]
+	rp.mu.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if t, ok := rp.transports[key]; ok {
+		return t, nil
+	}
+
+	t, err := key.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	rp.transports[key] = t
+	return t, nil
+}
+
+// retain brings the upstream pools in line with pools, keeping the health
+// state of targets that stay, and drops the transports of origins whose
+// host is not in active, closing their idle connections.
+func (rp *reverseProxy) retain(pools map[string]poolConfig, active map[string]bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	for name := range rp.pools {
+		if _, ok := pools[name]; !ok {
+			delete(rp.pools, name)
+		}
+	}
+	for name, pc := range pools {
+		p, ok := rp.pools[name]
+		if !ok {
+			p = &upstreamPool{}
+			rp.pools[name] = p
+		}
+		p.update(pc.targets, pc.lb)
+	}
+
+	for key, t := range rp.transports {
+		if !active[addressHost(key.address)] {
+			t.CloseIdleConnections()
+			delete(rp.transports, key)
+		}
+	}
+}
+
+// close releases the idle connections of every upstream and closes all
+// upgraded connections.
+func (rp *reverseProxy) close() {
+	rp.retain(nil, nil)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, cancel := range rp.upgrades {
+		cancel()
+	}
+}
+
+// isUpgradeRequest reports whether r asks to switch protocols
+// (Connection: Upgrade with an Upgrade header).
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addressHost strips the port and brackets from an origin address.
+func addressHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.Trim(address, "[]")
+}
+
+// upstreamHost brackets IPv6 origins so they can be used as a URL host.
+func upstreamHost(target string) string {
+	if strings.Contains(target, ":") && !strings.HasPrefix(target, "[") {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "[" + target + "]"
+		}
+	}
+	return target
+}
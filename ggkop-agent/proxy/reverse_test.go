@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range []string{"Connection", "X-Hop", "Keep-Alive"} {
+			if v := r.Header.Get(header); v != "" {
+				t.Errorf("backend got hop-by-hop header %s: %s", header, v)
+			}
+		}
+		if got := r.Header.Get("X-Forwarded-For"); got != "192.0.2.1" {
+			t.Errorf("X-Forwarded-For = %q, want 192.0.2.1", got)
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		io.WriteString(w, "hello")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	stats := &HTTPStats{}
+	rp := newReverseProxy(config.NewConfigManager("", "", ""), "HTTP", stats)
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = "192.0.2.1:1234"
+		rp.serve(w, r, proxyRoute{name: "example.com", targets: []string{strings.TrimPrefix(backend.URL, "http://")}}, config.HTTPProxy{})
+	}))
+	defer frontend.Close()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, frontend.URL, nil)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "hello" {
+			t.Errorf("body = %q, want hello", body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("trailer X-Checksum = %q, want abc", got)
+		}
+		if got := resp.Header.Get("X-Backend-Hop"); got != "" {
+			t.Errorf("response kept hop-by-hop header X-Backend-Hop: %s", got)
+		}
+	}
+
+	if n := len(rp.transports); n != 1 {
+		t.Errorf("transports = %d, want 1 pooled transport", n)
+	}
+	if stats.ProxyErrors != 0 {
+		t.Errorf("ProxyErrors = %d, want 0", stats.ProxyErrors)
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"192.0.2.10", "192.0.2.10"},
+		{"192.0.2.10:8080", "192.0.2.10:8080"},
+		{"2001:db8::1", "[2001:db8::1]"},
+		{"[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+	}
+
+	for _, tt := range tests {
+		if got := upstreamHost(tt.target); got != tt.want {
+			t.Errorf("upstreamHost(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestReverseProxyUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("backend got Upgrade %q, want websocket", r.Header.Get("Upgrade"))
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw) // echo
+	}))
+	defer backend.Close()
+
+	stats := &HTTPStats{}
+	rp := newReverseProxy(config.NewConfigManager("", "", ""), "HTTP", stats)
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.serve(w, r, proxyRoute{name: "example.com", targets: []string{strings.TrimPrefix(backend.URL, "http://")}}, config.HTTPProxy{})
+	}))
+	frontend.Config.ReadTimeout = 100 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// Outlive the server's read timeout before using the connection
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, %v; want ping", line, err)
+	}
+
+	if got := atomic.LoadInt64(&stats.ActiveUpgrades); got != 1 {
+		t.Errorf("ActiveUpgrades = %d, want 1", got)
+	}
+
+	rp.close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+	if got := atomic.LoadUint64(&stats.Upgrades); got != 1 {
+		t.Errorf("Upgrades = %d, want 1", got)
+	}
+}
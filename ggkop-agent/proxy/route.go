@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ggkop/agent/config"
+)
+
+// proxyRoute is where a request goes: the upstream pool called name and the
+// response header rules to apply.
+type proxyRoute struct {
+	name            string
+	targets         []string
+	responseHeaders config.HeaderRules
+	clientCert      *x509.Certificate // verified client identity for the origin
+}
+
+// removeResponseHeader drops name from origin responses on this route,
+// without touching the rule the header rules came from.
+func (route *proxyRoute) removeResponseHeader(name string) {
+	route.responseHeaders.Remove = append(slices.Clip(route.responseHeaders.Remove), name)
+}
+
+// routeRequest applies the first matching route rule of the domain to r,
+// rewriting its path and request headers, and returns the upstreams to use.
+// Without a matching rule, or when the rule has no upstreams of its own, the
+// host's records are used.
+func routeRequest(domainConfig *config.Domain, host string, r *http.Request) proxyRoute {
+	var route proxyRoute
+	for i := range domainConfig.HTTPProxy.Routes {
+		rule := &domainConfig.HTTPProxy.Routes[i]
+		if !matchRule(rule, r) {
+			continue
+		}
+
+		rewritePath(rule, r)
+		applyHeaderRules(r.Header, rule.RequestHeaders)
+		route.responseHeaders = rule.ResponseHeaders
+		if len(rule.Upstreams) > 0 {
+			route.name = rulePoolName(domainConfig.Domain, i)
+			route.targets = rule.Upstreams
+			return route
+		}
+		break
+	}
+
+	route.name, route.targets = findProxyTargets(domainConfig, host)
+	return route
+}
+
+// matchRule reports whether r matches every matcher of rule.
+func matchRule(rule *config.RouteRule, r *http.Request) bool {
+	path := r.URL.Path
+	if rule.PathPrefix != "" && !strings.HasPrefix(path, rule.PathPrefix) {
+		return false
+	}
+	if rule.PathRegex != "" {
+		re := compileRouteRegex(rule.PathRegex)
+		if re == nil || !re.MatchString(path) {
+			return false
+		}
+	}
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+	for name, want := range rule.Headers {
+		values, present := r.Header[http.CanonicalHeaderKey(name)]
+		if !present || (want != "" && !containsFold(values, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewritePath strips or replaces the matched prefix, or substitutes the
+// regex match, keeping the path absolute.
+func rewritePath(rule *config.RouteRule, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case rule.PathRegex != "" && rule.RewritePath != "":
+		path = compileRouteRegex(rule.PathRegex).ReplaceAllString(path, rule.RewritePath)
+	case rule.PathPrefix != "" && (rule.StripPrefix || rule.RewritePath != ""):
+		path = rule.RewritePath + strings.TrimPrefix(path, rule.PathPrefix)
+	default:
+		return
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
+}
+
+// rulePoolName names the upstream pool of the i-th route rule of a domain.
+func rulePoolName(domain string, i int) string {
+	return fmt.Sprintf("%s#route%d", domain, i)
+}
+
+func applyHeaderRules(header http.Header, rules config.HeaderRules) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+}
+
+func containsFold(values []string, want string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, want) {
+			return true
+		}
+	}
+	return false
+}
+
+var routeRegexes sync.Map // pattern → *regexp.Regexp, nil when invalid
+
+// compileRouteRegex compiles and caches a route pattern. Invalid patterns
+// are logged once and never match.
+func compileRouteRegex(pattern string) *regexp.Regexp {
+	if cached, ok := routeRegexes.Load(pattern); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("[Proxy] Invalid route pathRegex %q: %v", pattern, err)
+		re = nil
+	}
+	routeRegexes.Store(pattern, re)
+	return re
+}
+
+// findProxyTargets returns the upstreams for host in its domain and the
+// owner name they were found under, which names the upstream pool. The
+// A/AAAA records owned by host are used, else those of the closest wildcard
+// (*.example.com) above it. Of these, the records with the HTTP proxy
+// enabled are preferred; the others are only used when the proxy is enabled
+// for the whole domain.
+func findProxyTargets(domainConfig *config.Domain, host string) (string, []string) {
+	zone := domainConfig.Domain
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	owners := []string{host}
+	for name := host; name != zone && strings.HasSuffix(name, "."+zone); {
+		name = name[strings.IndexByte(name, '.')+1:]
+		owners = append(owners, "*."+name)
+	}
+
+	for _, owner := range owners {
+		var proxied, all []string
+		for _, record := range domainConfig.DNSRecords {
+			if record.Type != "A" && record.Type != "AAAA" {
+				continue
+			}
+			if recordOwner(record.Name, zone) != owner {
+				continue
+			}
+			all = append(all, record.Value)
+			if record.HTTPProxyEnabled {
+				proxied = append(proxied, record.Value)
+			}
+		}
+
+		if len(proxied) > 0 {
+			return owner, proxied
+		}
+		if len(all) > 0 {
+			if domainConfig.HTTPProxy.Enabled {
+				return owner, all
+			}
+			// An existing name is not covered by a wildcard
+			return owner, nil
+		}
+	}
+
+	return "", nil
+}
+
+// recordOwner returns the lowercase fully qualified owner name of a record
+// in zone. "@" is the apex and names ending in a dot are absolute.
+func recordOwner(name, zone string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@" || name == "":
+		return zone
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	default:
+		return name + "." + zone
+	}
+}
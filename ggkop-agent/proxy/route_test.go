@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestFindProxyTargets(t *testing.T) {
+	domain := &config.Domain{
+		Domain: "example.com",
+		DNSRecords: []config.DNSRecord{
+			{Name: "@", Type: "A", Value: "192.0.2.1", HTTPProxyEnabled: true},
+			{Name: "www", Type: "A", Value: "192.0.2.2", HTTPProxyEnabled: true},
+			{Name: "www", Type: "AAAA", Value: "2001:db8::2", HTTPProxyEnabled: true},
+			{Name: "api", Type: "A", Value: "192.0.2.3", HTTPProxyEnabled: true},
+			{Name: "api", Type: "A", Value: "192.0.2.4"},
+			{Name: "mail", Type: "A", Value: "192.0.2.5"},
+			{Name: "*.apps", Type: "A", Value: "192.0.2.6", HTTPProxyEnabled: true},
+			{Name: "*", Type: "A", Value: "192.0.2.7", HTTPProxyEnabled: true},
+			{Name: "Static.Example.Com.", Type: "A", Value: "192.0.2.8", HTTPProxyEnabled: true},
+		},
+	}
+
+	tests := []struct {
+		host      string
+		wantOwner string
+		want      []string
+	}{
+		{"example.com", "example.com", []string{"192.0.2.1"}},
+		{"WWW.example.com", "www.example.com", []string{"192.0.2.2", "2001:db8::2"}},
+		{"api.example.com", "api.example.com", []string{"192.0.2.3"}},
+		{"mail.example.com", "mail.example.com", nil},
+		{"one.apps.example.com", "*.apps.example.com", []string{"192.0.2.6"}},
+		{"deep.one.apps.example.com", "*.apps.example.com", []string{"192.0.2.6"}},
+		{"other.example.com", "*.example.com", []string{"192.0.2.7"}},
+		{"static.example.com", "static.example.com", []string{"192.0.2.8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			owner, targets := findProxyTargets(domain, tt.host)
+			if owner != tt.wantOwner || !slices.Equal(targets, tt.want) {
+				t.Errorf("findProxyTargets() = %s %v, want %s %v", owner, targets, tt.wantOwner, tt.want)
+			}
+		})
+	}
+
+	// With the proxy enabled for the whole domain, unflagged records are used
+	domain.HTTPProxy.Enabled = true
+	if _, targets := findProxyTargets(domain, "mail.example.com"); !slices.Equal(targets, []string{"192.0.2.5"}) {
+		t.Errorf("findProxyTargets(mail) = %v, want [192.0.2.5]", targets)
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	domain := &config.Domain{
+		Domain: "example.com",
+		DNSRecords: []config.DNSRecord{
+			{Name: "@", Type: "A", Value: "192.0.2.1", HTTPProxyEnabled: true},
+		},
+		HTTPProxy: config.HTTPProxy{Routes: []config.RouteRule{
+			{PathPrefix: "/api/", StripPrefix: true, Methods: []string{"GET", "POST"}, Upstreams: []string{"192.0.2.10"},
+				RequestHeaders: config.HeaderRules{Set: map[string]string{"X-Route": "api"}, Remove: []string{"Cookie"}}},
+			{PathPrefix: "/static/", RewritePath: "/assets/", Upstreams: []string{"192.0.2.20", "192.0.2.21"}},
+			{PathRegex: `^/v(\d+)/users$`, RewritePath: "/users/v$1", Headers: map[string]string{"X-Beta": ""}},
+			{PathPrefix: "/admin", Headers: map[string]string{"X-Admin": "yes"}, Upstreams: []string{"192.0.2.30"},
+				ResponseHeaders: config.HeaderRules{Set: map[string]string{"Cache-Control": "no-store"}}},
+			{PathRegex: `(`, Upstreams: []string{"192.0.2.99"}},
+		}},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		header      http.Header
+		wantName    string
+		wantTargets []string
+		wantPath    string
+	}{
+		{"strip prefix", "GET", "/api/v1/items", http.Header{"Cookie": {"a=b"}}, "example.com#route0", []string{"192.0.2.10"}, "/v1/items"},
+		{"method mismatch", "DELETE", "/api/v1/items", nil, "example.com", []string{"192.0.2.1"}, "/api/v1/items"},
+		{"rewrite prefix", "GET", "/static/app.js", nil, "example.com#route1", []string{"192.0.2.20", "192.0.2.21"}, "/assets/app.js"},
+		{"regex keeps host upstreams", "GET", "/v2/users", http.Header{"X-Beta": {"1"}}, "example.com", []string{"192.0.2.1"}, "/users/v2"},
+		{"regex needs header", "GET", "/v2/users", nil, "example.com", []string{"192.0.2.1"}, "/v2/users"},
+		{"header value", "GET", "/admin/panel", http.Header{"X-Admin": {"YES"}}, "example.com#route3", []string{"192.0.2.30"}, "/admin/panel"},
+		{"header value mismatch", "GET", "/admin/panel", http.Header{"X-Admin": {"no"}}, "example.com", []string{"192.0.2.1"}, "/admin/panel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+
+			route := routeRequest(domain, "example.com", r)
+			if route.name != tt.wantName || !slices.Equal(route.targets, tt.wantTargets) {
+				t.Errorf("route = %s %v, want %s %v", route.name, route.targets, tt.wantName, tt.wantTargets)
+			}
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("path = %s, want %s", r.URL.Path, tt.wantPath)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/api/x", nil)
+	r.Header.Set("Cookie", "a=b")
+	routeRequest(domain, "example.com", r)
+	if r.Header.Get("X-Route") != "api" || r.Header.Get("Cookie") != "" {
+		t.Errorf("request headers = %v, want X-Route set and Cookie removed", r.Header)
+	}
+}
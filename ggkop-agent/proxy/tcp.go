@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,9 +15,12 @@ import (
 
 type ProxyManager struct {
 	configMgr     *config.ConfigManager
+	bindHost      string
 	activeProxies map[int]*TCPProxy
+	udpProxies    map[int]*UDPProxy
 	mu            sync.RWMutex
 	stopChan      chan struct{}
+	watchDone     chan struct{} // closed when watchProxies returns
 }
 
 type TCPProxy struct {
@@ -23,6 +28,13 @@ type TCPProxy struct {
 	listener net.Listener
 	stopChan chan struct{}
 	stats    *ProxyStats
+	conns    sync.WaitGroup
+}
+
+type UDPProxy struct {
+	config   config.Proxy
+	conn     *net.UDPConn
+	stopChan chan struct{}
 }
 
 type ProxyStats struct {
@@ -33,19 +45,72 @@ type ProxyStats struct {
 	mu                sync.RWMutex
 }
 
-func StartProxyManager(configMgr *config.ConfigManager) {
+// StartProxyManager starts the TCP/UDP proxies configured in Core, bound to
+// bindHost ("" for all interfaces), and keeps them in sync with the
+// configuration in the background.
+func StartProxyManager(configMgr *config.ConfigManager, bindHost string) *ProxyManager {
 	manager := &ProxyManager{
 		configMgr:     configMgr,
+		bindHost:      bindHost,
 		activeProxies: make(map[int]*TCPProxy),
+		udpProxies:    make(map[int]*UDPProxy),
 		stopChan:      make(chan struct{}),
+		watchDone:     make(chan struct{}),
 	}
 
 	go manager.watchProxies()
 
-	<-manager.stopChan
+	return manager
+}
+
+// Shutdown stops every proxy listener and waits for open TCP connections to
+// finish until ctx expires.
+func (pm *ProxyManager) Shutdown(ctx context.Context) error {
+	close(pm.stopChan)
+
+	// A running update could otherwise start a proxy after the ones below stop
+	select {
+	case <-pm.watchDone:
+	case <-ctx.Done():
+		return fmt.Errorf("TCP proxies: %w", ctx.Err())
+	}
+
+	pm.mu.Lock()
+	tcpProxies := make([]*TCPProxy, 0, len(pm.activeProxies))
+	for port, proxy := range pm.activeProxies {
+		proxy.Stop()
+		tcpProxies = append(tcpProxies, proxy)
+		delete(pm.activeProxies, port)
+	}
+	for port, proxy := range pm.udpProxies {
+		proxy.Stop()
+		delete(pm.udpProxies, port)
+	}
+	pm.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, proxy := range tcpProxies {
+			proxy.conns.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("TCP proxies: %w", ctx.Err())
+	}
+}
+
+func (pm *ProxyManager) listenAddr(port int) string {
+	return net.JoinHostPort(pm.bindHost, strconv.Itoa(port))
 }
 
 func (pm *ProxyManager) watchProxies() {
+	defer close(pm.watchDone)
+
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
@@ -66,13 +131,19 @@ func (pm *ProxyManager) updateProxies() {
 
 	currentPorts := make(map[int]bool)
 	for _, proxy := range proxies {
+		select {
+		case <-pm.stopChan:
+			return
+		default:
+		}
 		currentPorts[proxy.ListenPort] = true
 
 		pm.mu.RLock()
-		_, exists := pm.activeProxies[proxy.ListenPort]
+		_, tcpExists := pm.activeProxies[proxy.ListenPort]
+		_, udpExists := pm.udpProxies[proxy.ListenPort]
 		pm.mu.RUnlock()
 
-		if !exists {
+		if !tcpExists && !udpExists {
 			pm.startProxy(proxy)
 		}
 	}
@@ -85,6 +156,13 @@ func (pm *ProxyManager) updateProxies() {
 			delete(pm.activeProxies, port)
 		}
 	}
+	for port, proxy := range pm.udpProxies {
+		if !currentPorts[port] {
+			log.Printf("[Proxy] Stopping proxy on port %d", port)
+			proxy.Stop()
+			delete(pm.udpProxies, port)
+		}
+	}
 	pm.mu.Unlock()
 }
 
@@ -106,7 +184,7 @@ func (pm *ProxyManager) startProxy(proxyConfig config.Proxy) {
 }
 
 func (pm *ProxyManager) startTCPProxy(proxyConfig config.Proxy) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", proxyConfig.ListenPort))
+	listener, err := net.Listen("tcp", pm.listenAddr(proxyConfig.ListenPort))
 	if err != nil {
 		log.Printf("[TCP Proxy] Failed to start on port %d: %v", proxyConfig.ListenPort, err)
 		return
@@ -123,8 +201,8 @@ func (pm *ProxyManager) startTCPProxy(proxyConfig config.Proxy) {
 	pm.activeProxies[proxyConfig.ListenPort] = proxy
 	pm.mu.Unlock()
 
-	log.Printf("[TCP Proxy] Started: %s on :%d → %s:%d",
-		proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.TargetHost, proxyConfig.TargetPort)
+	log.Printf("[TCP Proxy] Started: %s on %s → %s:%d",
+		proxyConfig.Name, listener.Addr(), proxyConfig.TargetHost, proxyConfig.TargetPort)
 
 	go proxy.Accept()
 }
@@ -153,11 +231,13 @@ func (p *TCPProxy) Accept() {
 		p.stats.ActiveConnections++
 		p.stats.mu.Unlock()
 
+		p.conns.Add(1)
 		go p.handleConnection(conn)
 	}
 }
 
 func (p *TCPProxy) handleConnection(clientConn net.Conn) {
+	defer p.conns.Done()
 	defer clientConn.Close()
 	defer func() {
 		p.stats.mu.Lock()
@@ -165,7 +245,7 @@ func (p *TCPProxy) handleConnection(clientConn net.Conn) {
 		p.stats.mu.Unlock()
 	}()
 
-	targetAddr := fmt.Sprintf("%s:%d", p.config.TargetHost, p.config.TargetPort)
+	targetAddr := net.JoinHostPort(p.config.TargetHost, strconv.Itoa(p.config.TargetPort))
 	targetConn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
 	if err != nil {
 		log.Printf("[TCP Proxy] Failed to connect to backend %s: %v", targetAddr, err)
@@ -202,7 +282,7 @@ func (p *TCPProxy) Stop() {
 }
 
 func (pm *ProxyManager) startUDPProxy(proxyConfig config.Proxy) {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", proxyConfig.ListenPort))
+	addr, err := net.ResolveUDPAddr("udp", pm.listenAddr(proxyConfig.ListenPort))
 	if err != nil {
 		log.Printf("[UDP Proxy] Failed to resolve address: %v", err)
 		return
@@ -214,28 +294,50 @@ func (pm *ProxyManager) startUDPProxy(proxyConfig config.Proxy) {
 		return
 	}
 
-	log.Printf("[UDP Proxy] Started: %s on :%d → %s:%d",
-		proxyConfig.Name, proxyConfig.ListenPort, proxyConfig.TargetHost, proxyConfig.TargetPort)
+	proxy := &UDPProxy{
+		config:   proxyConfig,
+		conn:     conn,
+		stopChan: make(chan struct{}),
+	}
+
+	pm.mu.Lock()
+	pm.udpProxies[proxyConfig.ListenPort] = proxy
+	pm.mu.Unlock()
+
+	log.Printf("[UDP Proxy] Started: %s on %s → %s:%d",
+		proxyConfig.Name, conn.LocalAddr(), proxyConfig.TargetHost, proxyConfig.TargetPort)
 
-	go handleUDPProxy(conn, proxyConfig)
+	go proxy.Serve()
 }
 
-func handleUDPProxy(conn *net.UDPConn, proxyConfig config.Proxy) {
-	defer conn.Close()
+func (p *UDPProxy) Serve() {
+	defer p.conn.Close()
 
 	buffer := make([]byte, 65535)
 
 	for {
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		n, clientAddr, err := p.conn.ReadFromUDP(buffer)
 		if err != nil {
-			log.Printf("[UDP Proxy] Read error: %v", err)
-			continue
+			select {
+			case <-p.stopChan:
+				return
+			default:
+				log.Printf("[UDP Proxy] Read error: %v", err)
+				continue
+			}
 		}
 
-		go forwardUDP(conn, clientAddr, buffer[:n], proxyConfig)
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		go forwardUDP(p.conn, clientAddr, data, p.config)
 	}
 }
 
+func (p *UDPProxy) Stop() {
+	close(p.stopChan)
+	p.conn.Close()
+}
+
 func forwardUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []byte, proxyConfig config.Proxy) {
 	targetAddr, err := net.ResolveUDPAddr("udp",
 		fmt.Sprintf("%s:%d", proxyConfig.TargetHost, proxyConfig.TargetPort))
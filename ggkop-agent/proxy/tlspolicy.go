@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ggkop/agent/acme"
+	"github.com/ggkop/agent/config"
+)
+
+// Headers carrying the verified client certificate to the origin. They are
+// removed from every incoming request so clients cannot forge them.
+var clientCertHeaders = []string{
+	"X-Client-Verify",
+	"X-Client-Cert-Subject",
+	"X-Client-Cert-Issuer",
+	"X-Client-Cert-Serial",
+	"X-Client-Cert-Fingerprint",
+}
+
+var defaultNextProtos = []string{"h2", "http/1.1"}
+
+// tlsPolicies serves the per-domain handshake settings (ssl.tls) through
+// GetConfigForClient. The configs are built on first use and dropped when
+// the configuration changes.
+type tlsPolicies struct {
+	configMgr *config.ConfigManager
+	base      *tls.Config
+	extra     []string // ALPN protocols offered for every domain
+
+	mu      sync.Mutex
+	configs map[string]tlsPolicyConfig
+}
+
+type tlsPolicyConfig struct {
+	config *tls.Config
+	err    error
+}
+
+func newTLSPolicies(configMgr *config.ConfigManager, base *tls.Config, extra []string) *tlsPolicies {
+	p := &tlsPolicies{
+		configMgr: configMgr,
+		base:      base,
+		extra:     extra,
+		configs:   make(map[string]tlsPolicyConfig),
+	}
+	configMgr.OnUpdate(func(*config.Config) {
+		p.mu.Lock()
+		p.configs = make(map[string]tlsPolicyConfig)
+		p.mu.Unlock()
+	})
+	return p
+}
+
+// getConfigForClient returns the domain's config, or nil for the defaults.
+// An invalid policy fails the handshake rather than silently weakening it.
+func (p *tlsPolicies) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	// ACME validation handshakes carry no client certificate
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		return nil, nil
+	}
+
+	domainConfig := p.configMgr.FindDomain(hello.ServerName)
+	if domainConfig == nil || !hasTLSPolicy(domainConfig.SSL.TLS) {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.configs[domainConfig.Domain]
+	if !ok {
+		entry.config, entry.err = buildTLSConfig(p.base, domainConfig.SSL.TLS, p.extra)
+		if entry.err != nil {
+			entry.err = fmt.Errorf("TLS policy of %s: %w", domainConfig.Domain, entry.err)
+			log.Printf("[HTTPS] Invalid %v", entry.err)
+		}
+		p.configs[domainConfig.Domain] = entry
+	}
+	return entry.config, entry.err
+}
+
+func hasTLSPolicy(policy config.TLSPolicy) bool {
+	return policy.MinVersion != "" || policy.MaxVersion != "" || len(policy.CipherSuites) > 0 ||
+		len(policy.ALPN) > 0 || policy.ClientAuth.Mode != ""
+}
+
+// buildTLSConfig applies policy to a copy of base.
+func buildTLSConfig(base *tls.Config, policy config.TLSPolicy, extra []string) (*tls.Config, error) {
+	cfg := base.Clone()
+	cfg.GetConfigForClient = nil
+
+	var err error
+	if policy.MinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(policy.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MaxVersion != "" {
+		if cfg.MaxVersion, err = parseTLSVersion(policy.MaxVersion); err != nil {
+			return nil, err
+		}
+		if cfg.MaxVersion < cfg.MinVersion {
+			return nil, errors.New("maxVersion is below minVersion")
+		}
+	}
+
+	if len(policy.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range policy.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	protos := defaultNextProtos
+	if len(policy.ALPN) > 0 {
+		for _, proto := range policy.ALPN {
+			if proto != "h2" && proto != "http/1.1" {
+				return nil, fmt.Errorf("unsupported ALPN protocol %q", proto)
+			}
+		}
+		protos = policy.ALPN
+	}
+	cfg.NextProtos = append(append([]string(nil), protos...), extra...)
+
+	switch strings.ToLower(policy.ClientAuth.Mode) {
+	case "", "off":
+	case "optional", "require":
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(policy.ClientAuth.CACert)) {
+			return nil, errors.New("clientAuth requires a valid caCert")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if requiresClientCert(policy) {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		return nil, fmt.Errorf("unknown clientAuth mode %q", policy.ClientAuth.Mode)
+	}
+	return cfg, nil
+}
+
+// requiresClientCert reports whether policy only admits clients with a
+// verified certificate, which plain HTTP cannot provide.
+func requiresClientCert(policy config.TLSPolicy) bool {
+	return strings.EqualFold(policy.ClientAuth.Mode, "require")
+}
+
+// allowsHTTP3 reports whether policy permits TLS 1.3, which QUIC requires.
+func allowsHTTP3(policy config.TLSPolicy) bool {
+	return policy.MaxVersion == "" || policy.MaxVersion == "1.3"
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// misdirected reports whether a request arrived on a connection negotiated
+// for another domain (HTTP/2 connection reuse) while its own domain has a
+// TLS policy the connection may not satisfy.
+func misdirected(r *http.Request, domainConfig *config.Domain, configMgr *config.ConfigManager) bool {
+	if r.TLS == nil || !hasTLSPolicy(domainConfig.SSL.TLS) {
+		return false
+	}
+	sniDomain := configMgr.FindDomain(r.TLS.ServerName)
+	return sniDomain == nil || sniDomain.Domain != domainConfig.Domain
+}
+
+// clientCertificate returns the client certificate verified on the
+// connection of r if that connection was negotiated for r's domain. On a
+// connection reused across domains the certificate was checked against
+// another domain's CA and is no identity for this one.
+func clientCertificate(r *http.Request, domainConfig *config.Domain, configMgr *config.ConfigManager) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	sniDomain := configMgr.FindDomain(r.TLS.ServerName)
+	if sniDomain == nil || sniDomain.Domain != domainConfig.Domain {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func stripClientCertHeaders(header http.Header) {
+	for _, name := range clientCertHeaders {
+		header.Del(name)
+	}
+}
+
+// setClientCertHeaders replaces the client-certificate headers of out with
+// the identity of cert, if any.
+func setClientCertHeaders(out http.Header, cert *x509.Certificate) {
+	stripClientCertHeaders(out)
+	if cert == nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	out.Set("X-Client-Verify", "SUCCESS")
+	out.Set("X-Client-Cert-Subject", cert.Subject.String())
+	out.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	out.Set("X-Client-Cert-Serial", strings.ToUpper(cert.SerialNumber.Text(16)))
+	out.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+}
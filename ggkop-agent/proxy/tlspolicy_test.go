@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestBuildTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	server.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	tests := []struct {
+		name       string
+		policy     config.TLSPolicy
+		wantMin    uint16
+		wantMax    uint16
+		wantProtos []string
+		wantAuth   tls.ClientAuthType
+		wantErr    bool
+	}{
+		{"defaults", config.TLSPolicy{}, tls.VersionTLS12, 0, []string{"h2", "http/1.1", "acme-tls/1"}, tls.NoClientCert, false},
+		{"TLS 1.3 only", config.TLSPolicy{MinVersion: "1.3", MaxVersion: "1.3"}, tls.VersionTLS13, tls.VersionTLS13, []string{"h2", "http/1.1", "acme-tls/1"}, tls.NoClientCert, false},
+		{"HTTP/1.1 only", config.TLSPolicy{ALPN: []string{"http/1.1"}}, tls.VersionTLS12, 0, []string{"http/1.1", "acme-tls/1"}, tls.NoClientCert, false},
+		{"optional client cert", config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "optional", CACert: caPEM}}, tls.VersionTLS12, 0, []string{"h2", "http/1.1", "acme-tls/1"}, tls.VerifyClientCertIfGiven, false},
+		{"required client cert", config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "require", CACert: caPEM}}, tls.VersionTLS12, 0, []string{"h2", "http/1.1", "acme-tls/1"}, tls.RequireAndVerifyClientCert, false},
+		{"client cert without CA", config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "require"}}, 0, 0, nil, 0, true},
+		{"unknown client auth", config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "maybe", CACert: caPEM}}, 0, 0, nil, 0, true},
+		{"unknown version", config.TLSPolicy{MinVersion: "1.4"}, 0, 0, nil, 0, true},
+		{"max below min", config.TLSPolicy{MinVersion: "1.3", MaxVersion: "1.2"}, 0, 0, nil, 0, true},
+		{"insecure cipher", config.TLSPolicy{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, 0, 0, nil, 0, true},
+		{"unknown ALPN", config.TLSPolicy{ALPN: []string{"h3"}}, 0, 0, nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := buildTLSConfig(base, tt.policy, []string{"acme-tls/1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.MinVersion != tt.wantMin || cfg.MaxVersion != tt.wantMax {
+				t.Errorf("versions = %x-%x, want %x-%x", cfg.MinVersion, cfg.MaxVersion, tt.wantMin, tt.wantMax)
+			}
+			if !reflect.DeepEqual(cfg.NextProtos, tt.wantProtos) {
+				t.Errorf("NextProtos = %v, want %v", cfg.NextProtos, tt.wantProtos)
+			}
+			if cfg.ClientAuth != tt.wantAuth {
+				t.Errorf("ClientAuth = %v, want %v", cfg.ClientAuth, tt.wantAuth)
+			}
+		})
+	}
+
+	cfg, err := buildTLSConfig(base, config.TLSPolicy{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, nil)
+	if err != nil || !reflect.DeepEqual(cfg.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("CipherSuites = %v (error %v)", cfg.CipherSuites, err)
+	}
+}
+
+func TestSetClientCertHeaders(t *testing.T) {
+	cert := &x509.Certificate{
+		Raw:          []byte("certificate"),
+		SerialNumber: big.NewInt(0xabc),
+		Subject:      pkix.Name{CommonName: "client"},
+		Issuer:       pkix.Name{CommonName: "Client CA"},
+	}
+
+	header := http.Header{"X-Client-Verify": {"SUCCESS"}, "X-Client-Cert-Subject": {"CN=forged"}}
+	setClientCertHeaders(header, nil)
+	if len(header) != 0 {
+		t.Errorf("unverified connection kept headers %v", header)
+	}
+
+	setClientCertHeaders(header, cert)
+	want := http.Header{
+		"X-Client-Verify":           {"SUCCESS"},
+		"X-Client-Cert-Subject":     {"CN=client"},
+		"X-Client-Cert-Issuer":      {"CN=Client CA"},
+		"X-Client-Cert-Serial":      {"ABC"},
+		"X-Client-Cert-Fingerprint": {"03d66dd08835c1ca3f128cceacd1f31ac94163096b20f445ae84285bc0832d72"},
+	}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("headers = %v, want %v", header, want)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	configMgr := newTestConfigManager(t,
+		config.Domain{Domain: "example.com"},
+		config.Domain{Domain: "example.net"},
+	)
+	domainConfig := configMgr.FindDomain("example.com")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+
+	tests := []struct {
+		name       string
+		serverName string
+		chains     [][]*x509.Certificate
+		want       *x509.Certificate
+	}{
+		{"same domain", "example.com", [][]*x509.Certificate{{cert}}, cert},
+		{"subdomain", "www.example.com", [][]*x509.Certificate{{cert}}, cert},
+		{"connection for another domain", "example.net", [][]*x509.Certificate{{cert}}, nil},
+		{"unknown server name", "example.org", [][]*x509.Certificate{{cert}}, nil},
+		{"unverified", "example.com", nil, nil},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: tt.serverName, VerifiedChains: tt.chains}
+		if got := clientCertificate(r, domainConfig, configMgr); got != tt.want {
+			t.Errorf("%s: clientCertificate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestConfigManager returns a ConfigManager loaded with domains from a
+// fake Core.
+func newTestConfigManager(t *testing.T, domains ...config.Domain) *config.ConfigManager {
+	t.Helper()
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(config.PollResponse{Success: true, Domains: domains})
+	}))
+	t.Cleanup(core.Close)
+
+	configMgr := config.NewConfigManager(core.URL, "agent", "key")
+	go configMgr.StartPolling(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); configMgr.FindDomain(domains[0].Domain) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration not loaded")
+		}
+	}
+	return configMgr
+}
+
+func TestHTTPProxyRequiredClientCert(t *testing.T) {
+	required := config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "require"}}
+	optional := config.TLSPolicy{ClientAuth: config.ClientAuth{Mode: "optional"}}
+	configMgr := newTestConfigManager(t,
+		config.Domain{Domain: "mtls.example", HTTPProxy: config.HTTPProxy{Enabled: true, Type: "http"}, SSL: config.SSL{TLS: required}},
+		config.Domain{Domain: "open.example", HTTPProxy: config.HTTPProxy{Enabled: true, Type: "http"}, SSL: config.SSL{TLS: optional}},
+	)
+	server := &HTTPProxyServer{configMgr: configMgr, stats: &HTTPStats{}}
+	server.proxy = newReverseProxy(configMgr, "HTTP", server.stats)
+
+	rec := httptest.NewRecorder()
+	server.handleRequest(rec, httptest.NewRequest(http.MethodPost, "http://mtls.example/api?x=1", nil))
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://mtls.example/api?x=1" {
+		t.Errorf("required client cert: %d to %q, want 308 to HTTPS", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Optional client certificates keep plain HTTP; without records it has no backend
+	rec = httptest.NewRecorder()
+	server.handleRequest(rec, httptest.NewRequest(http.MethodGet, "http://open.example/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("optional client cert: status %d, want 502 from the proxy path", rec.Code)
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+const (
+	defaultMaxFails    = 3
+	defaultFailTimeout = 30 * time.Second
+	defaultRetries     = 2
+)
+
+// upstream is one origin address of a pool with its passive health state.
+type upstream struct {
+	target string
+	active int64 // in-flight requests, for least_conn
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.ejectedUntil)
+}
+
+func (u *upstream) success() {
+	u.mu.Lock()
+	u.fails = 0
+	u.mu.Unlock()
+}
+
+// failure records an error and reports whether it ejected the upstream.
+func (u *upstream) failure(maxFails int, failTimeout time.Duration) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fails++
+	if maxFails <= 0 || u.fails < maxFails {
+		return false
+	}
+	u.fails = 0
+	u.ejectedUntil = time.Now().Add(failTimeout)
+	return true
+}
+
+// upstreamPool balances requests over the upstreams of one domain.
+type upstreamPool struct {
+	next uint64
+
+	mu        sync.RWMutex
+	upstreams []*upstream
+	lb        config.LoadBalancing
+}
+
+// update replaces the targets and settings, keeping the health state of
+// targets that stay in the pool.
+func (p *upstreamPool) update(targets []string, lb config.LoadBalancing) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lb = lb
+	if slices.EqualFunc(p.upstreams, targets, func(u *upstream, target string) bool { return u.target == target }) {
+		return
+	}
+
+	existing := make(map[string]*upstream, len(p.upstreams))
+	for _, u := range p.upstreams {
+		existing[u.target] = u
+	}
+	upstreams := make([]*upstream, 0, len(targets))
+	for _, target := range targets {
+		u, ok := existing[target]
+		if !ok {
+			u = &upstream{target: target}
+		}
+		upstreams = append(upstreams, u)
+	}
+	p.upstreams = upstreams
+}
+
+// settings returns the load-balancing settings with defaults applied.
+// Negative MaxFails or Retries disable ejection or retries.
+func (p *upstreamPool) settings() (lb config.LoadBalancing, failTimeout time.Duration) {
+	p.mu.RLock()
+	lb = p.lb
+	p.mu.RUnlock()
+
+	if lb.MaxFails == 0 {
+		lb.MaxFails = defaultMaxFails
+	}
+	if lb.Retries == 0 {
+		lb.Retries = defaultRetries
+	}
+	failTimeout = defaultFailTimeout
+	if lb.FailTimeout > 0 {
+		failTimeout = time.Duration(lb.FailTimeout) * time.Second
+	}
+	return lb, failTimeout
+}
+
+// pick chooses an upstream for r that is not in tried. Ejected upstreams are
+// only used when no healthy one is left.
+func (p *upstreamPool) pick(r *http.Request, tried map[*upstream]bool) *upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	var healthy, ejected []*upstream
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		}
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			ejected = append(ejected, u)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.lb.Algorithm {
+	case "least_conn":
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			u := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+		return best
+	case "ip_hash":
+		return hashPick(candidates, getClientIP(r))
+	case "cookie_hash":
+		if cookie, err := r.Cookie(p.lb.Cookie); err == nil && cookie.Value != "" {
+			return hashPick(candidates, cookie.Value)
+		}
+		return hashPick(candidates, getClientIP(r))
+	default:
+		return candidates[atomic.AddUint64(&p.next, 1)%uint64(len(candidates))]
+	}
+}
+
+// hashPick uses rendezvous hashing, so a key keeps its upstream unless that
+// upstream leaves the candidate list.
+func hashPick(candidates []*upstream, key string) *upstream {
+	var best *upstream
+	var bestScore uint64
+	for _, u := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(u.target))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+// isIdempotent reports whether req may be sent again to another upstream.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// trackBody calls done once when the response body is closed. Bodies of
+// switched-protocol responses stay writable for the upgrade splice.
+func trackBody(body io.ReadCloser, done func()) io.ReadCloser {
+	var once sync.Once
+	release := func() { once.Do(done) }
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedRWBody{rwc, release}
+	}
+	return &trackedBody{body, release}
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	defer b.done()
+	return b.ReadCloser.Close()
+}
+
+type trackedRWBody struct {
+	io.ReadWriteCloser
+	done func()
+}
+
+func (b *trackedRWBody) Close() error {
+	defer b.done()
+	return b.ReadWriteCloser.Close()
+}
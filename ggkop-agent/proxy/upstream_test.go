@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ggkop/agent/config"
+)
+
+func TestUpstreamPoolPick(t *testing.T) {
+	targets := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	tests := []struct {
+		name     string
+		lb       config.LoadBalancing
+		requests []*http.Request
+		want     []string
+	}{
+		{
+			name:     "round robin",
+			lb:       config.LoadBalancing{},
+			requests: []*http.Request{clientRequest("198.51.100.1", ""), clientRequest("198.51.100.1", ""), clientRequest("198.51.100.1", ""), clientRequest("198.51.100.1", "")},
+			want:     []string{"192.0.2.2", "192.0.2.3", "192.0.2.1", "192.0.2.2"},
+		},
+		{
+			name:     "ip hash is sticky",
+			lb:       config.LoadBalancing{Algorithm: "ip_hash"},
+			requests: []*http.Request{clientRequest("198.51.100.7", ""), clientRequest("198.51.100.7", "")},
+			want:     []string{"192.0.2.1", "192.0.2.1"},
+		},
+		{
+			name:     "cookie hash",
+			lb:       config.LoadBalancing{Algorithm: "cookie_hash", Cookie: "session"},
+			requests: []*http.Request{clientRequest("198.51.100.1", "abc"), clientRequest("198.51.100.2", "abc")},
+			want:     []string{"192.0.2.2", "192.0.2.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &upstreamPool{}
+			pool.update(targets, tt.lb)
+			for i, r := range tt.requests {
+				if got := pool.pick(r, nil).target; got != tt.want[i] {
+					t.Errorf("request %d picked %s, want %s", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolEjection(t *testing.T) {
+	pool := &upstreamPool{}
+	pool.update([]string{"192.0.2.1", "192.0.2.2"}, config.LoadBalancing{Algorithm: "least_conn"})
+	first, second := pool.upstreams[0], pool.upstreams[1]
+
+	second.active = 5
+	for i := 0; i < defaultMaxFails; i++ {
+		ejected := first.failure(defaultMaxFails, time.Minute)
+		if ejected != (i == defaultMaxFails-1) {
+			t.Fatalf("failure %d: ejected = %v", i+1, ejected)
+		}
+	}
+
+	if got := pool.pick(clientRequest("198.51.100.1", ""), nil); got != second {
+		t.Errorf("picked %s, want the healthy %s", got.target, second.target)
+	}
+	if got := pool.pick(clientRequest("198.51.100.1", ""), map[*upstream]bool{second: true}); got != first {
+		t.Errorf("picked %v, want the ejected upstream when no healthy one is left", got)
+	}
+
+	// Keeping a target keeps its health state
+	pool.update([]string{"192.0.2.1", "192.0.2.3"}, config.LoadBalancing{})
+	if pool.upstreams[0] != first || pool.upstreams[0].healthy(time.Now()) {
+		t.Error("update() reset the state of a remaining upstream")
+	}
+}
+
+func TestReverseProxyConfigurePools(t *testing.T) {
+	rp := newReverseProxy(config.NewConfigManager("", "", ""), "HTTP", &HTTPStats{})
+	cfg := &config.Config{Domains: []config.Domain{{
+		Domain: "example.com",
+		DNSRecords: []config.DNSRecord{
+			{Name: "@", Type: "A", Value: "192.0.2.1", HTTPProxyEnabled: true},
+			{Name: "@", Type: "A", Value: "192.0.2.2"},
+			{Name: "*", Type: "A", Value: "192.0.2.3", HTTPProxyEnabled: true},
+		},
+		HTTPProxy: config.HTTPProxy{
+			LoadBalancing: config.LoadBalancing{Algorithm: "least_conn"},
+			Routes:        []config.RouteRule{{PathPrefix: "/api", Upstreams: []string{"192.0.2.9"}}},
+		},
+	}}}
+	rp.configure(cfg)
+
+	targets := func(p *upstreamPool) []string {
+		var out []string
+		for _, u := range p.upstreams {
+			out = append(out, u.target)
+		}
+		return out
+	}
+	apex := rp.pool("example.com", nil, config.LoadBalancing{})
+	if got := targets(apex); !reflect.DeepEqual(got, []string{"192.0.2.1"}) || apex.lb.Algorithm != "least_conn" {
+		t.Errorf("apex pool = %v (%q), want the proxied record with least_conn", got, apex.lb.Algorithm)
+	}
+	if got := targets(rp.pool("*.example.com", nil, config.LoadBalancing{})); !reflect.DeepEqual(got, []string{"192.0.2.3"}) {
+		t.Errorf("wildcard pool = %v", got)
+	}
+	if got := targets(rp.pool(rulePoolName("example.com", 0), nil, config.LoadBalancing{})); !reflect.DeepEqual(got, []string{"192.0.2.9"}) {
+		t.Errorf("route pool = %v", got)
+	}
+
+	// A new configuration updates the pool in place; requests only read it
+	cfg.Domains[0].DNSRecords[1].HTTPProxyEnabled = true
+	rp.configure(cfg)
+	if p := rp.pool("example.com", []string{"192.0.2.1"}, config.LoadBalancing{}); p != apex || len(p.upstreams) != 2 {
+		t.Errorf("apex pool after update = %v, want both records in the same pool", targets(p))
+	}
+
+	cfg.Domains = nil
+	rp.configure(cfg)
+	if p := rp.pool("example.com", []string{"192.0.2.5"}, config.LoadBalancing{}); p == apex || !reflect.DeepEqual(targets(p), []string{"192.0.2.5"}) {
+		t.Errorf("removed pool was kept: %v", targets(p))
+	}
+}
+
+func TestReverseProxyRetry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	// A closed port refuses connections
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	targets := []string{dead.Addr().String(), strings.TrimPrefix(backend.URL, "http://")}
+	lb := config.LoadBalancing{Algorithm: "ip_hash", MaxFails: 1}
+
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPost, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			stats := &HTTPStats{}
+			rp := newReverseProxy(config.NewConfigManager("", "", ""), "HTTP", stats)
+			// Find a client address that hashes to the dead upstream first
+			pool := rp.pool("example.com", targets, lb)
+			var client string
+			for i := 1; client == ""; i++ {
+				ip := "198.51.100." + strconv.Itoa(i)
+				if pool.pick(clientRequest(ip, ""), nil).target == targets[0] {
+					client = ip
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "http://example.com/", strings.NewReader(""))
+			req.RemoteAddr = client + ":1234"
+			rec := httptest.NewRecorder()
+			rp.serve(rec, req, proxyRoute{name: "example.com", targets: targets}, config.HTTPProxy{LoadBalancing: lb})
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if stats.UpstreamsEjected != 1 {
+				t.Errorf("UpstreamsEjected = %d, want 1", stats.UpstreamsEjected)
+			}
+		})
+	}
+}
+
+func clientRequest(ip, session string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = ip + ":1234"
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	return r
+}
@@ -10,7 +10,7 @@ echo ""
 # Check if Go is installed
 if ! command -v go &> /dev/null; then
     echo "❌ Error: Go is not installed"
-    echo "Please install Go 1.21 or higher"
+    echo "Please install Go 1.24 or higher"
     echo "Visit: https://golang.org/dl/"
     exit 1
 fi